@@ -0,0 +1,209 @@
+package knuckles
+
+import (
+  "bufio"
+  "encoding/json"
+  "fmt"
+  "io"
+  "math/rand"
+  "net"
+  "net/http"
+  "os"
+  "strconv"
+  "sync"
+  "time"
+)
+
+const (
+  LogJSON     = "json"
+  LogCombined = "combined"
+)
+
+// AccessLogConfig writes to the file at Path, or to stdout when Path is
+// "-". Format is LogJSON (default) or LogCombined. Sample is the share of
+// requests logged, 0 logs them all.
+type AccessLogConfig struct {
+  Path   string
+  Format string
+  Sample float64
+}
+
+type AccessLogEntry struct {
+  Time      time.Time `json:"time"`
+  ClientIP  string    `json:"client_ip"`
+  Method    string    `json:"method"`
+  URI       string    `json:"uri"`
+  Proto     string    `json:"proto"`
+  Hostname  string    `json:"hostname"`
+  App       string    `json:"application"`
+  Backend   string    `json:"backend"`
+  Status    int       `json:"status"`
+  Bytes     int64     `json:"bytes"`
+  Referer   string    `json:"referer"`
+  UserAgent string    `json:"user_agent"`
+  Websocket bool      `json:"websocket"`
+
+  // seconds, waiting for the backend and overall
+  Upstream float64 `json:"upstream_time"`
+  Total    float64 `json:"total_time"`
+}
+
+type AccessLog struct {
+  path   string
+  format string
+  sample float64
+
+  mu   sync.Mutex
+  out  io.Writer
+  file *os.File
+}
+
+func NewAccessLog(config AccessLogConfig) (*AccessLog, error) {
+  l := &AccessLog{
+    path:   config.Path,
+    format: config.Format,
+    sample: config.Sample,
+  }
+
+  if l.format == "" {
+    l.format = LogJSON
+  }
+
+  if l.format != LogJSON && l.format != LogCombined {
+    return nil, ErrInvalidAccessLog
+  }
+
+  if l.sample < 0 || l.sample > 1 || l.path == "" {
+    return nil, ErrInvalidAccessLog
+  }
+
+  if l.path == "-" {
+    l.out = os.Stdout
+    return l, nil
+  }
+
+  return l, l.Reopen()
+}
+
+// Reopen starts writing to a fresh file at the same path, for logrotate
+func (l *AccessLog) Reopen() error {
+  if l.path == "-" {
+    return nil
+  }
+
+  file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+  if err != nil {
+    return err
+  }
+
+  l.mu.Lock()
+  old := l.file
+  l.file = file
+  l.out = file
+  l.mu.Unlock()
+
+  if old != nil {
+    old.Close()
+  }
+
+  return nil
+}
+
+func (l *AccessLog) Close() error {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  if l.file == nil {
+    return nil
+  }
+
+  err := l.file.Close()
+  l.file = nil
+  l.out = nil
+
+  return err
+}
+
+// sampled picks the requests to log
+func (l *AccessLog) sampled() bool {
+  return l.sample == 0 || l.sample == 1 || rand.Float64() < l.sample
+}
+
+func (l *AccessLog) Log(e AccessLogEntry) {
+  var line []byte
+
+  if l.format == LogCombined {
+    line = []byte(combinedLine(e))
+  } else {
+    line, _ = json.Marshal(e)
+    line = append(line, '\n')
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  if l.out != nil {
+    l.out.Write(line)
+  }
+}
+
+// combinedLine is the Apache combined format followed by the hostname,
+// application, backend, both latencies and "ws" for websockets
+func combinedLine(e AccessLogEntry) string {
+  size := "-"
+  if e.Bytes > 0 {
+    size = strconv.FormatInt(e.Bytes, 10)
+  }
+
+  ws := "-"
+  if e.Websocket {
+    ws = "ws"
+  }
+
+  return fmt.Sprintf("%s - - [%s] %q %d %s %q %q %s %s %s %.3f %.3f %s\n",
+    orDash(e.ClientIP), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+    e.Method+" "+e.URI+" "+e.Proto, e.Status, size, orDash(e.Referer), orDash(e.UserAgent),
+    orDash(e.Hostname), orDash(e.App), orDash(e.Backend), e.Upstream, e.Total, ws)
+}
+
+func orDash(s string) string {
+  if s == "" {
+    return "-"
+  }
+
+  return s
+}
+
+// loggedResponse counts what is written back to the client
+type loggedResponse struct {
+  http.ResponseWriter
+  status int
+  bytes  int64
+}
+
+func (w *loggedResponse) WriteHeader(status int) {
+  if w.status == 0 {
+    w.status = status
+  }
+  w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggedResponse) Write(b []byte) (int, error) {
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+
+  n, err := w.ResponseWriter.Write(b)
+  w.bytes += int64(n)
+
+  return n, err
+}
+
+func (w *loggedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  hj, ok := w.ResponseWriter.(http.Hijacker)
+  if !ok {
+    return nil, nil, ErrInvalidAction
+  }
+
+  return hj.Hijack()
+}
@@ -0,0 +1,92 @@
+package knuckles
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func Test_AccessLog(t *testing.T) {
+  dir, err := ioutil.TempDir("", "knuckles-log")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  path := filepath.Join(dir, "access.log")
+
+  backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte("hello"))
+  }))
+  defer backend.Close()
+
+  s := NewMemoryStore()
+  s.AddApplication("testapp")
+  s.AddHostname("testapp", "something.com")
+  s.AddBackend("testapp", strings.TrimPrefix(backend.URL, "http://"), 0, 0)
+
+  h, err := NewHTTPProxy(HTTPProxyConfig{Store: s, AccessLog: path})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  get := func(host string) {
+    r, _ := http.NewRequest("GET", "http://"+host+"/path?q=1", nil)
+    r.RequestURI = "/path?q=1"
+    h.ServeHTTP(httptest.NewRecorder(), r)
+  }
+
+  get("something.com")
+
+  // logrotate moves the file away, then sends SIGHUP
+  err = os.Rename(path, path+".1")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  h.ReopenLog()
+  get("nothing.com")
+
+  var entry AccessLogEntry
+
+  raw, _ := ioutil.ReadFile(path + ".1")
+  err = json.Unmarshal(raw, &entry)
+  if err != nil {
+    t.Fatal(err, string(raw))
+  }
+
+  if entry.Hostname != "something.com" || entry.App != "testapp" || entry.Status != 200 ||
+    entry.Bytes != 5 || entry.URI != "/path?q=1" || !strings.HasPrefix(backend.URL, "http://"+entry.Backend) {
+    t.Fatal("Invalid entry", entry)
+  }
+
+  raw, _ = ioutil.ReadFile(path)
+  err = json.Unmarshal(raw, &entry)
+  if err != nil {
+    t.Fatal(err, string(raw))
+  }
+
+  if entry.Hostname != "nothing.com" || entry.Status != http.StatusNotFound || entry.Backend != "" {
+    t.Fatal("Invalid entry after reopen", entry)
+  }
+
+  line := combinedLine(entry)
+  if !strings.Contains(line, `"GET /path?q=1 HTTP/1.1" 404`) || !strings.Contains(line, " nothing.com - - ") {
+    t.Fatal("Invalid combined line", line)
+  }
+
+  _, err = NewAccessLog(AccessLogConfig{Path: "-", Format: "xml"})
+  if err != ErrInvalidAccessLog {
+    t.Fatal("Accepted unknown format", err)
+  }
+
+  _, err = NewAccessLog(AccessLogConfig{Path: "-", Sample: 2})
+  if err != ErrInvalidAccessLog {
+    t.Fatal("Accepted invalid sample", err)
+  }
+}
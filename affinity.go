@@ -0,0 +1,69 @@
+package knuckles
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "strings"
+)
+
+const DefaultAffinityCookie = "knuckles_affinity"
+
+// affinity cookie value: base64(app \n backend) "." base64(hmac)
+func signAffinity(secret []byte, app, backend string) string {
+  payload := base64.URLEncoding.EncodeToString([]byte(app + "\n" + backend))
+  return payload + "." + affinityMAC(secret, payload)
+}
+
+func verifyAffinity(secret []byte, value string) (string, string, bool) {
+  sep := strings.LastIndex(value, ".")
+  if sep < 0 {
+    return "", "", false
+  }
+
+  payload := value[:sep]
+  if !hmac.Equal([]byte(value[sep+1:]), []byte(affinityMAC(secret, payload))) {
+    return "", "", false
+  }
+
+  raw, err := base64.URLEncoding.DecodeString(payload)
+  if err != nil {
+    return "", "", false
+  }
+
+  parts := strings.SplitN(string(raw), "\n", 2)
+  if len(parts) != 2 {
+    return "", "", false
+  }
+
+  return parts[0], parts[1], true
+}
+
+func affinityMAC(secret []byte, payload string) string {
+  mac := hmac.New(sha256.New, secret)
+  mac.Write([]byte(payload))
+  return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomSecret() []byte {
+  secret := make([]byte, 32)
+  rand.Read(secret)
+  return secret
+}
+
+// pinnedBackend returns the backend the client is pinned to when it is
+// still among the live ones.
+func pinnedBackend(app string, live []string, ctx *RequestContext) (string, bool) {
+  if ctx == nil || ctx.PinnedApp != app || ctx.Pinned == "" {
+    return "", false
+  }
+
+  for _, be := range live {
+    if be == ctx.Pinned {
+      return be, true
+    }
+  }
+
+  return "", false
+}
@@ -2,32 +2,69 @@ package knuckles
 
 import (
   "encoding/json"
+  "fmt"
+  "log"
   "net"
   "net/http"
   "strconv"
+  "strings"
+  "sync/atomic"
+  "time"
+)
+
+// DefaultPingTimeout bounds the store round trip of readiness checks
+const DefaultPingTimeout = 2 * time.Second
+
+const (
+  StatusLive        = "live"
+  StatusReady       = "ready"
+  StatusUnavailable = "unavailable"
+  StatusDraining    = "draining"
 )
 
 type HTTPAPIConfig struct {
-  Store Store
-  Addr  string
+  Store       Store
+  Addr        string
+  Pinger      *Pinger
+  Reaper      *Reaper
+  Proxies     map[string]*HTTPProxy
+  PingTimeout time.Duration
 }
 
 type HTTPAPI struct {
-  Server   http.Server
-  Db       Store
-  listener net.Listener
-  Addr     string
+  Server      http.Server
+  Db          Store
+  Pinger      *Pinger
+  Reaper      *Reaper
+  Proxies     map[string]*HTTPProxy
+  listener    net.Listener
+  Addr        string
+  pingTimeout time.Duration
+  draining    int32
 }
 
 func NewHTTPAPI(config HTTPAPIConfig) (*HTTPAPI, error) {
   h := &HTTPAPI{
-    Db:   config.Store,
-    Addr: config.Addr,
+    Db:          config.Store,
+    Pinger:      config.Pinger,
+    Reaper:      config.Reaper,
+    Proxies:     config.Proxies,
+    Addr:        config.Addr,
+    pingTimeout: config.PingTimeout,
+  }
+
+  if h.pingTimeout <= 0 {
+    h.pingTimeout = DefaultPingTimeout
   }
 
   mux := http.NewServeMux()
   mux.HandleFunc("/status", h.ServeStatus)
+  mux.HandleFunc("/status/ready", h.ServeStatus)
+  mux.HandleFunc("/status/live", h.ServeLiveness)
   mux.HandleFunc("/api", h.ServeAPI)
+  mux.HandleFunc("/v1/", h.ServeV1)
+  mux.HandleFunc("/events", h.ServeEvents)
+  mux.HandleFunc("/metrics", h.ServeMetrics)
   h.Server.Handler = mux
 
   return h, nil
@@ -48,17 +85,257 @@ func (h *HTTPAPI) Stop() error {
   return h.listener.Close()
 }
 
+// Drain fails readiness checks from now on, so load balancers stop
+// sending traffic before the proxies are stopped
+func (h *HTTPAPI) Drain() {
+  atomic.StoreInt32(&h.draining, 1)
+}
+
+func (h *HTTPAPI) Draining() bool {
+  return atomic.LoadInt32(&h.draining) == 1
+}
+
+type StoreStatus struct {
+  Reachable bool    `json:"reachable"`
+  Latency   float64 `json:"latency"`
+  Error     string  `json:"error,omitempty"`
+}
+
+type StatusResponse struct {
+  Status    string          `json:"status"`
+  Draining  bool            `json:"draining"`
+  Store     *StoreStatus    `json:"store,omitempty"`
+  Listeners map[string]bool `json:"listeners"`
+  Pinger    *PingerStatus   `json:"pinger,omitempty"`
+}
+
+// status describes this node, the store is only pinged when asked to
+func (h *HTTPAPI) status(ping bool) StatusResponse {
+  sr := StatusResponse{
+    Draining:  h.Draining(),
+    Listeners: make(map[string]bool),
+  }
+
+  for name, proxy := range h.Proxies {
+    sr.Listeners[name] = proxy.Bound()
+  }
+
+  if h.Pinger != nil {
+    status := h.Pinger.Status()
+    sr.Pinger = &status
+  }
+
+  if ping {
+    store := h.pingStore()
+    sr.Store = &store
+  }
+
+  return sr
+}
+
+// pingStore times a store round trip, giving up after pingTimeout
+func (h *HTTPAPI) pingStore() StoreStatus {
+  start := time.Now()
+  done := make(chan error, 1)
+
+  go func() {
+    done <- h.Db.Ping()
+  }()
+
+  var err error
+
+  select {
+  case err = <-done:
+  case <-time.After(h.pingTimeout):
+    err = ErrPingTimeout
+  }
+
+  status := StoreStatus{
+    Reachable: err == nil,
+    Latency:   time.Since(start).Seconds(),
+  }
+
+  if err != nil {
+    status.Error = err.Error()
+  }
+
+  return status
+}
+
+// ServeStatus is the readiness check. It answers 503 while draining, when
+// the store is unreachable or when a listener is not bound.
 func (h *HTTPAPI) ServeStatus(w http.ResponseWriter, r *http.Request) {
+  sr := h.status(true)
+  sr.Status = StatusReady
+
+  if !sr.Store.Reachable {
+    sr.Status = StatusUnavailable
+  }
+
+  for _, bound := range sr.Listeners {
+    if !bound {
+      sr.Status = StatusUnavailable
+    }
+  }
+
+  if sr.Draining {
+    sr.Status = StatusDraining
+  }
+
+  writeStatus(w, sr)
+}
+
+// ServeLiveness answers 200 as long as the process serves requests, a
+// restart would not bring the store back
+func (h *HTTPAPI) ServeLiveness(w http.ResponseWriter, r *http.Request) {
+  sr := h.status(false)
+  sr.Status = StatusLive
+
+  writeStatus(w, sr)
+}
+
+func writeStatus(w http.ResponseWriter, sr StatusResponse) {
+  code := http.StatusOK
+  if sr.Status != StatusReady && sr.Status != StatusLive {
+    code = http.StatusServiceUnavailable
+  }
+
+  w.Header().Set("Cache-Control", "no-store")
+  writeJSON(w, code, &sr)
+}
+
+// ServeEvents streams store events as server-sent events, only those
+// of one application when asked to
+func (h *HTTPAPI) ServeEvents(w http.ResponseWriter, r *http.Request) {
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+    return
+  }
+
+  app := r.FormValue("application")
+
+  events := make(chan Event, 64)
+  h.Db.Subscribe(events)
+  defer h.Db.Unsubscribe(events)
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.WriteHeader(http.StatusOK)
+  flusher.Flush()
+
+  // comments keep idle connections from being dropped by intermediaries
+  keepAlive := time.NewTicker(30 * time.Second)
+  defer keepAlive.Stop()
+
+  for {
+    select {
+    case <-r.Context().Done():
+      return
+    case <-keepAlive.C:
+      fmt.Fprint(w, ": keep-alive\n\n")
+    case ev := <-events:
+      if app != "" && ev.App != app {
+        continue
+      }
+
+      raw, err := json.Marshal(ev)
+      if err != nil {
+        continue
+      }
+
+      fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, raw)
+    }
+
+    flusher.Flush()
+  }
+}
+
+// ServeMetrics answers in the Prometheus text format. Besides what this
+// process measured, backends are counted per application and state.
+func (h *HTTPAPI) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+  var metrics []*metric
+
+  // the process metrics still tell what is wrong while the store is down
+  counts, err := h.Db.CountBackends()
+  if err != nil {
+    log.Println("Failed to count backends:", err)
+  } else {
+    backends := newMetric(metricGauge, "knuckles_backends", "Backends by application and state.", "application", "state")
+    for app, count := range counts {
+      backends.set(float64(count.Live), app, StateLive)
+      backends.set(float64(count.Total-count.Live), app, StateDead)
+    }
+    metrics = append(metrics, backends)
+  }
+  metrics = append(metrics, processMetrics...)
+
+  if h.Reaper != nil {
+    reaped := newMetric(metricCounter, "knuckles_backends_reaped_total", "Backends removed after their ttl ran out.")
+    reaped.set(float64(h.Reaper.Reaped()))
+    metrics = append(metrics, reaped)
+  }
+
+  if cs, ok := h.Db.(cacheStats); ok && cs.CacheStats().Enabled {
+    stats := cs.CacheStats()
+    hits := newMetric(metricCounter, "knuckles_cache_hits_total", "Resolutions answered from the cache.")
+    hits.set(float64(stats.Hits))
+    misses := newMetric(metricCounter, "knuckles_cache_misses_total", "Resolutions read from the store.")
+    misses.set(float64(stats.Misses))
+    metrics = append(metrics, hits, misses)
+  }
+
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+  for _, m := range metrics {
+    m.write(w)
+  }
+}
+
+// cacheStats is implemented by stores caching resolutions
+type cacheStats interface {
+  CacheStats() CacheStats
 }
 
 type ListResponse struct {
   Applications []string `json:"applications"`
 }
 
+type StatsResponse struct {
+  Cache  CacheStats `json:"cache"`
+  Reaped uint64     `json:"reaped"`
+}
+
 type InfoResponse struct {
-  Application string          `json:"application"`
-  Hostnames   []string        `json:"hostnames"`
-  Backends    map[string]bool `json:"backends"`
+  Application string                 `json:"application"`
+  Hostnames   []string               `json:"hostnames"`
+  Backends    map[string]BackendInfo `json:"backends"`
+  Strategy    Strategy               `json:"strategy"`
+  Affinity    bool                   `json:"affinity"`
+  Routes      []Route                `json:"routes"`
+  HealthCheck HealthCheck            `json:"health_check"`
+}
+
+// describe answers both the info action and GET /v1/apps/{app}
+func (h *HTTPAPI) describe(app string) (InfoResponse, error) {
+  var err error
+
+  ir := InfoResponse{Application: app}
+  ir.Hostnames, ir.Backends, err = h.Db.DescribeApplication(app)
+  if err == nil {
+    ir.Strategy, err = h.Db.StrategyForApp(app)
+  }
+  if err == nil {
+    ir.Affinity, err = h.Db.AffinityForApp(app)
+  }
+  if err == nil {
+    ir.Routes, err = h.Db.RoutesForApp(app)
+  }
+  if err == nil {
+    ir.HealthCheck, err = h.Db.HealthCheckForApp(app)
+  }
+
+  return ir, err
 }
 
 func (h *HTTPAPI) ServeAPI(w http.ResponseWriter, r *http.Request) {
@@ -67,23 +344,60 @@ func (h *HTTPAPI) ServeAPI(w http.ResponseWriter, r *http.Request) {
   app := r.FormValue("application")
   backend := r.FormValue("backend")
   hostname := r.FormValue("hostname")
+  key := r.FormValue("key")
+  strategy := Strategy{Name: r.FormValue("strategy"), Key: key}
+  affinity, _ := strconv.ParseBool(r.FormValue("affinity"))
+  prefix := r.FormValue("prefix")
+  strip, _ := strconv.ParseBool(r.FormValue("strip"))
+  cert := r.FormValue("cert")
   ttlRaw := r.FormValue("ttl")
   ttl, _ := strconv.Atoi(ttlRaw)
+  weight, _ := strconv.Atoi(r.FormValue("weight"))
+  page := r.FormValue("page")
 
   switch action {
   case "add-application":
     err = h.Db.AddApplication(app)
   case "add-hostname":
     err = h.Db.AddHostname(app, hostname)
+  case "add-route":
+    err = h.Db.AddRoute(app, hostname, prefix, strip)
   case "add-backend":
-    err = h.Db.AddBackend(app, backend, ttl)
+    err = h.Db.AddBackend(app, backend, ttl, weight)
+  case "heartbeat":
+    err = h.Db.RenewBackend(app, backend, ttl)
+  case "set-weight":
+    err = h.Db.SetBackendWeight(app, backend, weight)
+
+  case "add-certificate":
+    err = h.Db.SetCertificate(hostname, cert, key)
 
   case "del-application":
     err = h.Db.RemoveApplication(app)
   case "del-hostname":
     err = h.Db.RemoveHostname(app, hostname)
+  case "del-route":
+    err = h.Db.RemoveRoute(app, hostname, prefix)
   case "del-backend":
     err = h.Db.RemoveBackend(app, backend)
+  case "del-certificate":
+    err = h.Db.RemoveCertificate(hostname)
+  case "del-error-page":
+    err = h.Db.RemoveErrorPage(app, page)
+
+  case "set-strategy":
+    err = h.Db.SetStrategy(app, strategy)
+  case "set-affinity":
+    err = h.Db.SetAffinity(app, affinity)
+  case "set-health-check":
+    var check HealthCheck
+    check, err = healthCheckForm(r)
+    if err == nil {
+      err = h.Db.SetHealthCheck(app, check)
+    }
+
+  case "set-error-page":
+    err = h.Db.SetErrorPage(app, page, r.FormValue("body"))
 
   case "list":
     lr := ListResponse{}
@@ -92,11 +406,20 @@ func (h *HTTPAPI) ServeAPI(w http.ResponseWriter, r *http.Request) {
       err = json.NewEncoder(w).Encode(&lr)
     }
   case "info":
-    ir := InfoResponse{Application: app}
-    ir.Hostnames, ir.Backends, err = h.Db.DescribeApplication(app)
+    var ir InfoResponse
+    ir, err = h.describe(app)
     if err == nil {
       err = json.NewEncoder(w).Encode(&ir)
     }
+  case "stats":
+    sr := StatsResponse{}
+    if cs, ok := h.Db.(cacheStats); ok {
+      sr.Cache = cs.CacheStats()
+    }
+    if h.Reaper != nil {
+      sr.Reaped = h.Reaper.Reaped()
+    }
+    err = json.NewEncoder(w).Encode(&sr)
   default:
     err = ErrInvalidAction
   }
@@ -105,3 +428,56 @@ func (h *HTTPAPI) ServeAPI(w http.ResponseWriter, r *http.Request) {
     http.Error(w, err.Error(), http.StatusInternalServerError)
   }
 }
+
+// healthCheckForm reads a HealthCheck, defaults fill what is missing.
+// Headers come as repeated "header=Name: value" fields.
+func healthCheckForm(r *http.Request) (HealthCheck, error) {
+  check := DefaultHealthCheck()
+
+  if kind := r.FormValue("type"); kind != "" {
+    check.Type = kind
+  }
+
+  check.Verify, _ = strconv.ParseBool(r.FormValue("verify"))
+
+  if path := r.FormValue("path"); path != "" {
+    check.Path = path
+  }
+
+  if method := r.FormValue("method"); method != "" {
+    check.Method = strings.ToUpper(method)
+  }
+
+  check.Status = r.FormValue("status")
+  check.Body = r.FormValue("body")
+
+  if timeout := r.FormValue("timeout"); timeout != "" {
+    d, err := time.ParseDuration(timeout)
+    if err != nil {
+      return check, ErrInvalidHealthCheck
+    }
+    check.Timeout = d
+  }
+
+  if interval := r.FormValue("interval"); interval != "" {
+    d, err := time.ParseDuration(interval)
+    if err != nil {
+      return check, ErrInvalidHealthCheck
+    }
+    check.Interval = d
+  }
+
+  for _, header := range r.Form["header"] {
+    sep := strings.Index(header, ":")
+    if sep <= 0 {
+      return check, ErrInvalidHealthCheck
+    }
+
+    if check.Headers == nil {
+      check.Headers = make(map[string]string)
+    }
+    check.Headers[strings.TrimSpace(header[:sep])] = strings.TrimSpace(header[sep+1:])
+  }
+
+  return check, nil
+}
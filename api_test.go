@@ -0,0 +1,77 @@
+package knuckles
+
+import (
+  "encoding/json"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+type downStore struct {
+  Store
+}
+
+func (s downStore) Ping() error {
+  return errors.New("Connection refused")
+}
+
+func (s downStore) CountBackends() (map[string]BackendCount, error) {
+  return nil, errors.New("Connection refused")
+}
+
+func Test_Status(t *testing.T) {
+  proxy, err := NewHTTPProxy(HTTPProxyConfig{Store: NewMemoryStore()})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  get := func(api *HTTPAPI, path string, code int, status string) StatusResponse {
+    w := httptest.NewRecorder()
+    r, _ := http.NewRequest("GET", path, nil)
+    api.Server.Handler.ServeHTTP(w, r)
+
+    var sr StatusResponse
+    err := json.Unmarshal(w.Body.Bytes(), &sr)
+    if err != nil {
+      t.Fatal(err, w.Body.String())
+    }
+
+    if w.Code != code || sr.Status != status {
+      t.Fatal("Unexpected", path, w.Code, w.Body.String())
+    }
+
+    return sr
+  }
+
+  api, _ := NewHTTPAPI(HTTPAPIConfig{Store: NewMemoryStore()})
+  sr := get(api, "/status", http.StatusOK, StatusReady)
+  if sr.Store == nil || !sr.Store.Reachable {
+    t.Fatal("Store not reported", sr)
+  }
+
+  api.Drain()
+  get(api, "/status/ready", http.StatusServiceUnavailable, StatusDraining)
+  get(api, "/status/live", http.StatusOK, StatusLive)
+
+  api, _ = NewHTTPAPI(HTTPAPIConfig{Store: downStore{NewMemoryStore()}})
+  sr = get(api, "/status", http.StatusServiceUnavailable, StatusUnavailable)
+  if sr.Store.Reachable || sr.Store.Error == "" {
+    t.Fatal("Store reported reachable", sr.Store)
+  }
+
+  sr = get(api, "/status/live", http.StatusOK, StatusLive)
+  if sr.Store != nil {
+    t.Fatal("Liveness pinged the store", sr.Store)
+  }
+
+  // listeners count once bound
+  api, _ = NewHTTPAPI(HTTPAPIConfig{
+    Store:   NewMemoryStore(),
+    Proxies: map[string]*HTTPProxy{"web": proxy},
+  })
+  sr = get(api, "/status", http.StatusServiceUnavailable, StatusUnavailable)
+  if bound, ok := sr.Listeners["web"]; !ok || bound {
+    t.Fatal("Listener reported bound", sr.Listeners)
+  }
+}
@@ -0,0 +1,261 @@
+package knuckles
+
+import (
+  "hash/fnv"
+  "math"
+  "math/rand"
+  "net/http"
+  "sort"
+  "sync"
+)
+
+const (
+  StrategyRandom           = "random"
+  StrategyRoundRobin       = "round-robin"
+  StrategyLeastOutstanding = "least-outstanding"
+  StrategyHashIP           = "hash-ip"
+  StrategyHashHeader       = "hash-header"
+  StrategyHashCookie       = "hash-cookie"
+)
+
+// Strategy selects how an application's live backends are picked.
+// Key names the header or cookie used by the hash strategies.
+type Strategy struct {
+  Name string `json:"name"`
+  Key  string `json:"key,omitempty"`
+}
+
+func DefaultStrategy() Strategy {
+  return Strategy{Name: StrategyRandom}
+}
+
+func (s Strategy) Validate() error {
+  switch s.Name {
+  case StrategyRandom, StrategyRoundRobin, StrategyLeastOutstanding, StrategyHashIP:
+    return nil
+  case StrategyHashHeader, StrategyHashCookie:
+    if s.Key == "" {
+      return ErrInvalidStrategy
+    }
+    return nil
+  }
+
+  return ErrInvalidStrategy
+}
+
+// RequestContext is what the proxy knows about the request being routed.
+// It may be nil when there is no request (tests, tools).
+// PinnedApp and Pinned come from a verified affinity cookie, Exclude
+// lists backends that already failed this request.
+type RequestContext struct {
+  Request     *http.Request
+  ClientIP    string
+  Outstanding *Outstanding
+  PinnedApp   string
+  Pinned      string
+  Exclude     map[string]bool
+}
+
+// candidates drops the backends ctx excludes
+func candidates(live []string, ctx *RequestContext) []string {
+  if ctx == nil || len(ctx.Exclude) == 0 {
+    return live
+  }
+
+  var kept []string
+  for _, be := range live {
+    if !ctx.Exclude[be] {
+      kept = append(kept, be)
+    }
+  }
+
+  return kept
+}
+
+// Outstanding tracks in-flight requests per backend.
+type Outstanding struct {
+  mu     sync.Mutex
+  counts map[string]int
+}
+
+func NewOutstanding() *Outstanding {
+  return &Outstanding{
+    counts: make(map[string]int),
+  }
+}
+
+func (o *Outstanding) Acquire(backend string) {
+  o.mu.Lock()
+  o.counts[backend]++
+  o.mu.Unlock()
+}
+
+func (o *Outstanding) Release(backend string) {
+  o.mu.Lock()
+  o.counts[backend]--
+  if o.counts[backend] <= 0 {
+    delete(o.counts, backend)
+  }
+  o.mu.Unlock()
+}
+
+func (o *Outstanding) Count(backend string) int {
+  o.mu.Lock()
+  defer o.mu.Unlock()
+  return o.counts[backend]
+}
+
+// Balancer holds the state strategies need between picks.
+type Balancer struct {
+  mu      sync.Mutex
+  current map[string]map[string]int
+}
+
+func NewBalancer() *Balancer {
+  return &Balancer{
+    current: make(map[string]map[string]int),
+  }
+}
+
+// Pick chooses one of backends for app. weights may be nil.
+func (b *Balancer) Pick(app string, strategy Strategy, backends []string, weights map[string]int, ctx *RequestContext) (string, error) {
+  if len(backends) == 0 {
+    return "", ErrNoBackend
+  }
+
+  // store member order is not stable
+  sorted := make([]string, len(backends))
+  copy(sorted, backends)
+  sort.Strings(sorted)
+
+  switch strategy.Name {
+  case StrategyRoundRobin:
+    return b.roundRobin(app, sorted, weights), nil
+  case StrategyLeastOutstanding:
+    if ctx != nil && ctx.Outstanding != nil {
+      return leastOutstanding(sorted, weights, ctx.Outstanding), nil
+    }
+  case StrategyHashIP, StrategyHashHeader, StrategyHashCookie:
+    if key := hashKey(strategy, ctx); key != "" {
+      return rendezvous(key, sorted, weights), nil
+    }
+  }
+
+  return weightedRandom(sorted, weights), nil
+}
+
+// smooth weighted round robin, as done by nginx
+func (b *Balancer) roundRobin(app string, backends []string, weights map[string]int) string {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  last := b.current[app]
+  current := make(map[string]int, len(backends))
+  total := 0
+  best := ""
+
+  for _, be := range backends {
+    w := weightOf(weights, be)
+    total += w
+    current[be] = last[be] + w
+
+    if best == "" || current[be] > current[best] {
+      best = be
+    }
+  }
+
+  current[best] -= total
+  b.current[app] = current
+
+  return best
+}
+
+func weightOf(weights map[string]int, backend string) int {
+  if w, ok := weights[backend]; ok && w > 0 {
+    return w
+  }
+  return 1
+}
+
+func weightedRandom(backends []string, weights map[string]int) string {
+  total := 0
+  for _, be := range backends {
+    total += weightOf(weights, be)
+  }
+
+  n := rand.Intn(total)
+  for _, be := range backends {
+    n -= weightOf(weights, be)
+    if n < 0 {
+      return be
+    }
+  }
+
+  return backends[len(backends)-1]
+}
+
+func leastOutstanding(backends []string, weights map[string]int, o *Outstanding) string {
+  var best []string
+  min := -1.0
+
+  for _, be := range backends {
+    c := float64(o.Count(be)) / float64(weightOf(weights, be))
+    if min < 0 || c < min {
+      min = c
+      best = best[:0]
+    }
+    if c == min {
+      best = append(best, be)
+    }
+  }
+
+  return best[rand.Intn(len(best))]
+}
+
+func hashKey(strategy Strategy, ctx *RequestContext) string {
+  if ctx == nil {
+    return ""
+  }
+
+  switch strategy.Name {
+  case StrategyHashIP:
+    return ctx.ClientIP
+  case StrategyHashHeader:
+    if ctx.Request != nil {
+      return ctx.Request.Header.Get(strategy.Key)
+    }
+  case StrategyHashCookie:
+    if ctx.Request != nil {
+      if c, err := ctx.Request.Cookie(strategy.Key); err == nil {
+        return c.Value
+      }
+    }
+  }
+
+  return ""
+}
+
+// rendezvous (highest random weight) hashing only moves the keys of a
+// backend that joins or leaves the set.
+func rendezvous(key string, backends []string, weights map[string]int) string {
+  var best string
+  var bestScore float64
+
+  for _, be := range backends {
+    h := fnv.New64a()
+    h.Write([]byte(key))
+    h.Write([]byte{0})
+    h.Write([]byte(be))
+
+    // map the hash into (0, 1) and scale by weight
+    u := (float64(h.Sum64()>>11) + 0.5) / float64(1<<53)
+    score := -float64(weightOf(weights, be)) / math.Log(u)
+
+    if best == "" || score > bestScore {
+      best = be
+      bestScore = score
+    }
+  }
+
+  return best
+}
@@ -0,0 +1,230 @@
+package knuckles
+
+import (
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// hostEntry holds what every resolution candidate of a hostname maps to,
+// most specific first
+type hostEntry struct {
+  apps    []string
+  routes  [][]Route
+  expires time.Time
+}
+
+// appEntry holds what backend selection needs for an application,
+// ttls are the expiries of the live backends that have one
+type appEntry struct {
+  live     []string
+  settings map[string]string
+  weights  map[string]int
+  ttls     map[string]int
+  expires  time.Time
+}
+
+// maxCachedHosts bounds the hostnames kept, they come from the Host header
+// of any client
+const maxCachedHosts = 10000
+
+type CacheStats struct {
+  Enabled bool   `json:"enabled"`
+  Hits    uint64 `json:"hits"`
+  Misses  uint64 `json:"misses"`
+}
+
+// resolveCache is the local read-through cache of RedisStore. Entries are
+// dropped by invalidation events and, as a safety net, after ttl. It keeps
+// nothing while paused, when invalidation events may be missed.
+type resolveCache struct {
+  hits   uint64
+  misses uint64
+  gen    uint64
+  mu     sync.Mutex
+  ttl    time.Duration
+  paused bool
+  hosts  map[string]hostEntry
+  apps   map[string]appEntry
+}
+
+func newResolveCache(ttl time.Duration) *resolveCache {
+  return &resolveCache{
+    ttl:   ttl,
+    hosts: make(map[string]hostEntry),
+    apps:  make(map[string]appEntry),
+  }
+}
+
+func (c *resolveCache) host(name string) (hostEntry, bool) {
+  c.mu.Lock()
+  e, ok := c.hosts[name]
+  if ok && !time.Now().Before(e.expires) {
+    delete(c.hosts, name)
+    ok = false
+  }
+  c.mu.Unlock()
+
+  return e, c.count(ok)
+}
+
+// generation changes on every invalidation, entries fetched
+// under an older one may be stale and are not stored
+func (c *resolveCache) generation() uint64 {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.gen
+}
+
+// setHost keeps hostnames that resolve somewhere, unknown ones would let
+// clients fill the cache with made up names
+func (c *resolveCache) setHost(name string, e hostEntry, gen uint64) {
+  if !e.known() {
+    return
+  }
+
+  now := time.Now()
+  e.expires = now.Add(c.ttl)
+
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if gen != c.gen || c.paused {
+    return
+  }
+
+  if _, ok := c.hosts[name]; !ok && len(c.hosts) >= maxCachedHosts {
+    c.evictHosts(now)
+  }
+  c.hosts[name] = e
+}
+
+// evictHosts drops the expired hostnames, or some random one when none
+// expired yet. Called with mu held.
+func (c *resolveCache) evictHosts(now time.Time) {
+  for name, e := range c.hosts {
+    if !now.Before(e.expires) {
+      delete(c.hosts, name)
+    }
+  }
+
+  for name, _ := range c.hosts {
+    if len(c.hosts) < maxCachedHosts {
+      break
+    }
+    delete(c.hosts, name)
+  }
+}
+
+func (c *resolveCache) app(name string) (appEntry, bool) {
+  c.mu.Lock()
+  e, ok := c.apps[name]
+  if ok && !time.Now().Before(e.expires) {
+    delete(c.apps, name)
+    ok = false
+  }
+  c.mu.Unlock()
+
+  return e, c.count(ok)
+}
+
+func (c *resolveCache) setApp(name string, e appEntry, gen uint64) {
+  e.expires = time.Now().Add(c.ttl)
+
+  // refetch once a backend expires, a heartbeat may have renewed it
+  for _, ttl := range e.ttls {
+    if at := time.Unix(int64(ttl)+1, 0); at.Before(e.expires) {
+      e.expires = at
+    }
+  }
+  c.mu.Lock()
+  if gen == c.gen && !c.paused {
+    c.apps[name] = e
+  }
+  c.mu.Unlock()
+}
+
+func (c *resolveCache) count(hit bool) bool {
+  if hit {
+    atomic.AddUint64(&c.hits, 1)
+  } else {
+    atomic.AddUint64(&c.misses, 1)
+  }
+
+  return hit
+}
+
+// invalidate drops what ev may have changed. Hostname changes flush every
+// host since wildcards make a single name affect many.
+func (c *resolveCache) invalidate(ev Event) {
+  if ev.Type == EventCertificateAdded || ev.Type == EventCertificateRemoved {
+    return
+  }
+
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  c.gen++
+
+  if ev.Hostname != "" || ev.Type == EventApplicationRemoved {
+    c.hosts = make(map[string]hostEntry)
+  }
+
+  if ev.App != "" {
+    delete(c.apps, ev.App)
+  }
+}
+
+// pause empties the cache and keeps it empty until resume
+func (c *resolveCache) pause() {
+  c.flush(true)
+}
+
+// resume empties the cache and starts filling it again, once no
+// invalidation can be missed
+func (c *resolveCache) resume() {
+  c.flush(false)
+}
+
+func (c *resolveCache) flush(paused bool) {
+  c.mu.Lock()
+  c.gen++
+  c.paused = paused
+  c.hosts = make(map[string]hostEntry)
+  c.apps = make(map[string]appEntry)
+  c.mu.Unlock()
+}
+
+func (c *resolveCache) stats() CacheStats {
+  return CacheStats{
+    Enabled: true,
+    Hits:    atomic.LoadUint64(&c.hits),
+    Misses:  atomic.LoadUint64(&c.misses),
+  }
+}
+
+// known tells whether any candidate has an application or routes
+func (e hostEntry) known() bool {
+  for i, app := range e.apps {
+    if app != "" || len(e.routes[i]) > 0 {
+      return true
+    }
+  }
+
+  return false
+}
+
+// resolve applies the path routes and hostnames, most specific candidate first
+func (e hostEntry) resolve(path string) (string, Route, error) {
+  for i, app := range e.apps {
+    if rt, ok := longestRoute(e.routes[i], path); ok {
+      return rt.App, rt, nil
+    }
+
+    if app != "" {
+      return app, Route{}, nil
+    }
+  }
+
+  return "", Route{}, ErrNoHostname
+}
@@ -0,0 +1,158 @@
+package knuckles
+
+import (
+  "bytes"
+  "html/template"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "sync"
+)
+
+// Kinds of error pages, each answered with its own status code
+const (
+  PageNoHostname   = "no-hostname"
+  PageNoBackend    = "no-backend"
+  PageBackendError = "backend-error"
+)
+
+var pageStatus = map[string]int{
+  PageNoHostname:   http.StatusNotFound,
+  PageNoBackend:    http.StatusServiceUnavailable,
+  PageBackendError: http.StatusBadGateway,
+}
+
+// ErrorPage is what error page templates are executed with. Error
+// details stay in the logs.
+type ErrorPage struct {
+  Status   int
+  Title    string
+  Hostname string
+  Path     string
+}
+
+var defaultErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.Title}}</title></head>
+<body><h1>{{.Status}} {{.Title}}</h1></body>
+</html>
+`))
+
+// pageKind is the kind of page answering err
+func pageKind(err error) string {
+  switch err {
+  case ErrNoHostname:
+    return PageNoHostname
+  case ErrNoBackend, ErrDeadBackend:
+    return PageNoBackend
+  }
+
+  return PageBackendError
+}
+
+// validErrorPage checks an application page. Unknown hostnames have no
+// application, only listeners answer them.
+func validErrorPage(kind, body string) error {
+  if _, ok := pageStatus[kind]; !ok || kind == PageNoHostname {
+    return ErrInvalidErrorPage
+  }
+
+  _, err := template.New(kind).Parse(body)
+  if err != nil {
+    return ErrInvalidErrorPage
+  }
+
+  return nil
+}
+
+// errorPages holds the templates of a listener, read once from files,
+// and those of applications, parsed the first time they are used
+type errorPages struct {
+  files map[string]*template.Template
+
+  mu     sync.Mutex
+  parsed map[string]*template.Template
+}
+
+// maxParsedPages bounds the application templates kept around
+const maxParsedPages = 64
+
+func newErrorPages(files map[string]string) (*errorPages, error) {
+  p := &errorPages{
+    files:  make(map[string]*template.Template),
+    parsed: make(map[string]*template.Template),
+  }
+
+  for kind, file := range files {
+    if file == "" {
+      continue
+    }
+
+    raw, err := ioutil.ReadFile(file)
+    if err != nil {
+      return nil, err
+    }
+
+    p.files[kind], err = template.New(kind).Parse(string(raw))
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  return p, nil
+}
+
+// template picks the application page body, then the listener file,
+// then the built-in page
+func (p *errorPages) template(kind, body string) *template.Template {
+  if body == "" {
+    if t, ok := p.files[kind]; ok {
+      return t
+    }
+    return defaultErrorPage
+  }
+
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  if t, ok := p.parsed[body]; ok {
+    return t
+  }
+
+  t, err := template.New(kind).Parse(body)
+  if err != nil {
+    log.Println("Invalid", kind, "error page:", err)
+    return defaultErrorPage
+  }
+
+  if len(p.parsed) >= maxParsedPages {
+    p.parsed = make(map[string]*template.Template)
+  }
+  p.parsed[body] = t
+
+  return t
+}
+
+// render writes the page of kind with its status code
+func (p *errorPages) render(w http.ResponseWriter, r *http.Request, kind, body string) {
+  status := pageStatus[kind]
+  page := ErrorPage{
+    Status:   status,
+    Title:    http.StatusText(status),
+    Hostname: r.Host,
+    Path:     r.URL.Path,
+  }
+
+  var buf bytes.Buffer
+  err := p.template(kind, body).Execute(&buf, page)
+  if err != nil {
+    log.Println("Failed to render", kind, "error page:", err)
+    buf.Reset()
+    defaultErrorPage.Execute(&buf, page)
+  }
+
+  w.Header().Set("Content-Type", "text/html; charset=utf-8")
+  w.Header().Set("Cache-Control", "no-store")
+  w.WriteHeader(status)
+  w.Write(buf.Bytes())
+}
@@ -0,0 +1,72 @@
+package knuckles
+
+import (
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "testing"
+)
+
+func Test_ErrorPages(t *testing.T) {
+  file, err := ioutil.TempFile("", "knuckles-page")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.Remove(file.Name())
+
+  file.WriteString("<p>{{.Hostname}} is unknown</p>")
+  file.Close()
+
+  s := NewMemoryStore()
+  s.AddApplication("testapp")
+  s.AddHostname("testapp", "something.com")
+
+  h, err := NewHTTPProxy(HTTPProxyConfig{
+    Store:               s,
+    ErrorPageNoHostname: file.Name(),
+    RedirectNoHostname:  "http://example.com/unknown",
+    RedirectNoBackend:   "http://example.com/down",
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  get := func(host string) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    r, _ := http.NewRequest("POST", "http://"+host+"/", strings.NewReader("data"))
+    h.ServeHTTP(w, r)
+    return w
+  }
+
+  // the file wins over the redirect
+  w := get("nothing.com")
+  if w.Code != http.StatusNotFound || w.Body.String() != "<p>nothing.com is unknown</p>" {
+    t.Fatal("Invalid no hostname page", w.Code, w.Body.String())
+  }
+
+  w = get("something.com")
+  if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "http://example.com/down?err=no-backend" {
+    t.Fatal("Invalid no backend redirect", w.Code, w.Header())
+  }
+
+  s.SetErrorPage("testapp", PageNoBackend, "<p>{{.Status}} {{.Title}}</p>")
+
+  w = get("something.com")
+  if w.Code != http.StatusServiceUnavailable || w.Body.String() != "<p>503 Service Unavailable</p>" {
+    t.Fatal("Invalid application page", w.Code, w.Body.String())
+  }
+
+  // nothing configured, the built-in page answers
+  s.AddBackend("testapp", "127.0.0.1:1", 0, 0)
+
+  w = get("something.com")
+  if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "502 Bad Gateway") {
+    t.Fatal("Invalid backend error page", w.Code, w.Body.String())
+  }
+
+  if strings.Contains(w.Body.String(), "127.0.0.1") {
+    t.Fatal("Error page leaks details", w.Body.String())
+  }
+}
@@ -12,4 +12,23 @@ var (
   ErrAppAlreadyExists      = errors.New("Application already exists")
   ErrNoApp                 = errors.New("Application does not exist")
   ErrInvalidAction         = errors.New("Invalid action")
+  ErrInvalidStrategy       = errors.New("Invalid strategy")
+  ErrInvalidWeight         = errors.New("Invalid weight")
+  ErrInvalidHostname       = errors.New("Invalid hostname")
+  ErrInvalidPrefix         = errors.New("Invalid path prefix")
+  ErrRouteAlreadyExists    = errors.New("Route already exists")
+  ErrNoRoute               = errors.New("Route does not exist")
+  ErrInvalidCertificate    = errors.New("Invalid certificate")
+  ErrNoCertificate         = errors.New("No certificate")
+  ErrBackendEjected        = errors.New("Backend ejected")
+  ErrInvalidHealthCheck    = errors.New("Invalid health check")
+  ErrNoTTL                 = errors.New("Backend has no ttl")
+  ErrScriptReply           = errors.New("Unexpected script reply")
+  ErrInvalidErrorPage      = errors.New("Invalid error page")
+  ErrNoErrorPage           = errors.New("No error page")
+  ErrInvalidAccessLog      = errors.New("Invalid access log")
+  ErrPingTimeout           = errors.New("Store ping timed out")
+  ErrNoResource            = errors.New("No such resource")
+  ErrMethodNotAllowed      = errors.New("Method not allowed")
+  ErrInvalidBody           = errors.New("Invalid request body")
 )
@@ -0,0 +1,216 @@
+package knuckles
+
+import (
+  "encoding/json"
+  "fmt"
+  "github.com/fiorix/go-redis/redis"
+  "log"
+  "os"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+const (
+  EventApplicationAdded   = "application-added"
+  EventApplicationRemoved = "application-removed"
+  EventHostnameAdded      = "hostname-added"
+  EventHostnameRemoved    = "hostname-removed"
+  EventRouteAdded         = "route-added"
+  EventRouteRemoved       = "route-removed"
+  EventBackendAdded       = "backend-added"
+  EventBackendRemoved     = "backend-removed"
+  EventBackendEnabled     = "backend-enabled"
+  EventBackendDisabled    = "backend-disabled"
+  EventBackendEjected     = "backend-ejected"
+  EventBackendWeight      = "backend-weight"
+  EventSettings           = "settings"
+  EventCertificateAdded   = "certificate-added"
+  EventCertificateRemoved = "certificate-removed"
+)
+
+// backend states in events
+const (
+  StateLive = "live"
+  StateDead = "dead"
+)
+
+// Event describes a Store mutation. Backend events carry the Old and New
+// state of the backend and, when known, the Reason of the change.
+type Event struct {
+  Type     string    `json:"type"`
+  App      string    `json:"app,omitempty"`
+  Hostname string    `json:"hostname,omitempty"`
+  Backend  string    `json:"backend,omitempty"`
+  Old      string    `json:"old,omitempty"`
+  New      string    `json:"new,omitempty"`
+  Reason   string    `json:"reason,omitempty"`
+  Time     time.Time `json:"time"`
+}
+
+func liveState(live bool) string {
+  if live {
+    return StateLive
+  }
+  return StateDead
+}
+
+// eventSubscribers fans events out to local channels. Slow readers miss
+// events rather than blocking the Store.
+type eventSubscribers struct {
+  mu    sync.Mutex
+  chans []chan Event
+}
+
+func (s *eventSubscribers) add(ch chan Event) {
+  s.mu.Lock()
+  s.chans = append(s.chans, ch)
+  s.mu.Unlock()
+}
+
+func (s *eventSubscribers) remove(ch chan Event) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for i, c := range s.chans {
+    if c == ch {
+      s.chans = append(s.chans[:i], s.chans[i+1:]...)
+      return
+    }
+  }
+}
+
+func (s *eventSubscribers) send(ev Event) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for _, ch := range s.chans {
+    select {
+    case ch <- ev:
+    default:
+    }
+  }
+}
+
+// Subscribe delivers the events of every process sharing this namespace to ch
+func (r *RedisStore) Subscribe(ch chan Event) {
+  r.subscribers.add(ch)
+  r.startWatch()
+}
+
+func (r *RedisStore) Unsubscribe(ch chan Event) {
+  r.subscribers.remove(ch)
+}
+
+func (r *RedisStore) startWatch() {
+  r.watchOnce.Do(func() {
+    go r.watch()
+  })
+}
+
+// notify publishes ev on the namespaced events channel
+func (r *RedisStore) notify(ev Event) {
+  if ev.Time.IsZero() {
+    ev.Time = time.Now()
+  }
+
+  raw, err := json.Marshal(ev)
+  if err != nil {
+    return
+  }
+
+  _, err = r.client.Publish(r.Key("events"), string(raw))
+  if err != nil {
+    log.Println("Failed to publish event", ev.Type, err)
+  }
+}
+
+// eventSync is published by a watcher to itself, seeing it come back
+// tells the subscription is in place. It never reaches subscribers.
+const eventSync = "sync"
+
+// watch follows the events channel on its own connection, resubscribing
+// when it drops. The cache is paused meanwhile, it would miss events.
+func (r *RedisStore) watch() {
+  sub := redis.New(r.host)
+  host, _ := os.Hostname()
+
+  for {
+    msgs := make(chan redis.PubSubMessage, 128)
+    stop := make(chan bool)
+    done := make(chan error, 1)
+    synced := make(chan bool)
+    token := fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano())
+
+    go func() {
+      done <- sub.Subscribe(r.Key("events"), msgs, stop)
+    }()
+    go r.sync(token, synced, stop)
+
+    err := r.dispatch(msgs, done, token, synced)
+    close(stop)
+
+    log.Println("Lost events subscription:", err)
+    atomic.StoreInt32(&r.watching, 0)
+    if r.cache != nil {
+      r.cache.pause()
+    }
+    time.Sleep(time.Second)
+  }
+}
+
+// sync publishes token until the subscription brings it back
+func (r *RedisStore) sync(token string, synced, stop chan bool) {
+  for {
+    r.notify(Event{Type: eventSync, Reason: token})
+
+    select {
+    case <-synced:
+      return
+    case <-stop:
+      return
+    case <-time.After(100 * time.Millisecond):
+    }
+  }
+}
+
+func (r *RedisStore) dispatch(msgs chan redis.PubSubMessage, done chan error, token string, synced chan bool) error {
+  for {
+    select {
+    case msg := <-msgs:
+      if msg.Error != nil {
+        return msg.Error
+      }
+
+      var ev Event
+      if json.Unmarshal([]byte(msg.Value), &ev) != nil {
+        continue
+      }
+
+      if ev.Type == eventSync {
+        if ev.Reason == token && atomic.CompareAndSwapInt32(&r.watching, 0, 1) {
+          close(synced)
+          if r.cache != nil {
+            r.cache.resume()
+          }
+        }
+        continue
+      }
+
+      if r.cache != nil {
+        r.cache.invalidate(ev)
+      }
+      r.subscribers.send(ev)
+    case err := <-done:
+      return err
+    }
+  }
+}
+
+func (m *MemoryStore) notify(ev Event) {
+  if ev.Time.IsZero() {
+    ev.Time = time.Now()
+  }
+
+  m.subscribers.send(ev)
+}
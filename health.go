@@ -0,0 +1,300 @@
+package knuckles
+
+import (
+  "crypto/tls"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const DefaultCheckTimeout = 2 * time.Second
+
+// DefaultCheckStatus is accepted when a check lists no status
+const DefaultCheckStatus = "200-399"
+
+const (
+  CheckTCP   = "tcp"
+  CheckTLS   = "tls"
+  CheckHTTP  = "http"
+  CheckHTTPS = "https"
+)
+
+// bodies are only searched this far
+const maxCheckBody = 64 * 1024
+
+// HealthCheck describes how the pinger probes the backends of an
+// application. Type is one of tcp (connect), tls (handshake), http or
+// https, Verify checks the certificate of the last two.
+// Status lists accepted codes and ranges, "200-299,304"; empty accepts
+// DefaultCheckStatus. Body, when set, must appear in the response.
+// A zero Interval uses the pinger's.
+type HealthCheck struct {
+  Type     string            `json:"type"`
+  Verify   bool              `json:"verify,omitempty"`
+  Path     string            `json:"path"`
+  Method   string            `json:"method"`
+  Status   string            `json:"status,omitempty"`
+  Body     string            `json:"body,omitempty"`
+  Headers  map[string]string `json:"headers,omitempty"`
+  Timeout  time.Duration     `json:"timeout"`
+  Interval time.Duration     `json:"interval,omitempty"`
+}
+
+// DefaultHealthCheck takes a 2xx or 3xx answer to GET / as alive
+func DefaultHealthCheck() HealthCheck {
+  return HealthCheck{
+    Type:    CheckHTTP,
+    Path:    "/",
+    Method:  "GET",
+    Timeout: DefaultCheckTimeout,
+  }
+}
+
+func (c HealthCheck) Validate() error {
+  if !strings.HasPrefix(c.Path, "/") || c.Method == "" || c.Timeout <= 0 || c.Interval < 0 {
+    return ErrInvalidHealthCheck
+  }
+
+  if strings.ContainsAny(c.Method, " \t\r\n") {
+    return ErrInvalidHealthCheck
+  }
+
+  switch c.Type {
+  case "", CheckTCP, CheckTLS, CheckHTTP, CheckHTTPS:
+  default:
+    return ErrInvalidHealthCheck
+  }
+
+  _, err := parseStatusRanges(c.Status)
+
+  return err
+}
+
+// HealthState is what the pinger remembers of a backend between probes:
+// the current run of results and the recent liveness transitions. It lives
+// in the Store so every pinger sees the same history.
+type HealthState struct {
+  Successes     int         `json:"successes"`
+  Failures      int         `json:"failures"`
+  Transitions   []time.Time `json:"transitions,omitempty"`
+  FlappingUntil time.Time   `json:"flapping_until"`
+  CertExpires   time.Time   `json:"cert_expires"`
+}
+
+func (s HealthState) Flapping() bool {
+  return time.Now().Before(s.FlappingUntil)
+}
+
+func (s HealthState) certExpires() *time.Time {
+  if s.CertExpires.IsZero() {
+    return nil
+  }
+
+  return &s.CertExpires
+}
+
+// observe counts a probe result
+func (s *HealthState) observe(alive bool) {
+  if alive {
+    s.Successes++
+    s.Failures = 0
+  } else {
+    s.Failures++
+    s.Successes = 0
+  }
+}
+
+// prune forgets the transitions older than window
+func (s *HealthState) prune(now time.Time, window time.Duration) {
+  recent := s.Transitions[:0]
+  for _, t := range s.Transitions {
+    if now.Sub(t) < window {
+      recent = append(recent, t)
+    }
+  }
+
+  s.Transitions = recent
+}
+
+// transition records a liveness change, forgetting those older than window
+func (s *HealthState) transition(now time.Time, window time.Duration) {
+  s.prune(now, window)
+  s.Transitions = append(s.Transitions, now)
+}
+
+type statusRange struct {
+  from, to int
+}
+
+func parseStatusRanges(spec string) ([]statusRange, error) {
+  var ranges []statusRange
+
+  for _, part := range strings.Split(spec, ",") {
+    part = strings.TrimSpace(part)
+    if part == "" {
+      continue
+    }
+
+    bounds := strings.SplitN(part, "-", 2)
+    from, err := strconv.Atoi(bounds[0])
+    if err != nil {
+      return nil, ErrInvalidHealthCheck
+    }
+
+    to := from
+    if len(bounds) == 2 {
+      to, err = strconv.Atoi(bounds[1])
+      if err != nil {
+        return nil, ErrInvalidHealthCheck
+      }
+    }
+
+    if from < 100 || to > 599 || from > to {
+      return nil, ErrInvalidHealthCheck
+    }
+
+    ranges = append(ranges, statusRange{from, to})
+  }
+
+  return ranges, nil
+}
+
+func (c HealthCheck) expects(code int) bool {
+  ranges, _ := parseStatusRanges(c.Status)
+  if len(ranges) == 0 {
+    ranges, _ = parseStatusRanges(DefaultCheckStatus)
+  }
+
+  for _, rg := range ranges {
+    if code >= rg.from && code <= rg.to {
+      return true
+    }
+  }
+
+  return false
+}
+
+// tlsConfig names the server after the Host header when there is one
+func (c HealthCheck) tlsConfig(endpoint string) *tls.Config {
+  name, _, err := net.SplitHostPort(endpoint)
+  if err != nil {
+    name = endpoint
+  }
+
+  for header, value := range c.Headers {
+    if strings.EqualFold(header, "Host") {
+      name = value
+      if host, _, err := net.SplitHostPort(value); err == nil {
+        name = host
+      }
+    }
+  }
+
+  return &tls.Config{
+    ServerName:         name,
+    InsecureSkipVerify: !c.Verify,
+  }
+}
+
+// certExpiry is when the leaf certificate of a connection expires
+func certExpiry(state *tls.ConnectionState) time.Time {
+  if state == nil || len(state.PeerCertificates) == 0 {
+    return time.Time{}
+  }
+
+  return state.PeerCertificates[0].NotAfter
+}
+
+// checkEndpoint probes endpoint as described by check, a nil error
+// means the backend is alive. TLS checks also return when the backend
+// certificate expires.
+func checkEndpoint(endpoint string, check HealthCheck) (time.Time, error) {
+  timeout := check.Timeout
+  if timeout <= 0 {
+    timeout = DefaultCheckTimeout
+  }
+  deadline := time.Now().Add(timeout)
+
+  switch check.Type {
+  case CheckTCP:
+    conn, err := net.DialTimeout("tcp", endpoint, timeout)
+    if err != nil {
+      return time.Time{}, err
+    }
+    conn.Close()
+    return time.Time{}, nil
+  case CheckTLS:
+    dialer := &net.Dialer{Deadline: deadline}
+    conn, err := tls.DialWithDialer(dialer, "tcp", endpoint, check.tlsConfig(endpoint))
+    if err != nil {
+      return time.Time{}, err
+    }
+    defer conn.Close()
+    state := conn.ConnectionState()
+    return certExpiry(&state), nil
+  case CheckHTTPS:
+    return checkHTTP("https", endpoint, check, timeout, deadline)
+  }
+
+  return checkHTTP("http", endpoint, check, timeout, deadline)
+}
+
+func checkHTTP(scheme, endpoint string, check HealthCheck, timeout time.Duration, deadline time.Time) (time.Time, error) {
+  var expires time.Time
+
+  tr := &http.Transport{
+    // the deadline covers the whole exchange, not only the dial
+    Dial: func(network, addr string) (net.Conn, error) {
+      conn, err := net.DialTimeout(network, addr, timeout)
+      if err == nil {
+        conn.SetDeadline(deadline)
+      }
+      return conn, err
+    },
+    TLSClientConfig: check.tlsConfig(endpoint),
+  }
+
+  req, err := http.NewRequest(check.Method, fmt.Sprintf("%s://%s%s", scheme, endpoint, check.Path), nil)
+  if err != nil {
+    return expires, err
+  }
+  req.Close = true
+
+  for name, value := range check.Headers {
+    if strings.EqualFold(name, "Host") {
+      req.Host = value
+    } else {
+      req.Header.Set(name, value)
+    }
+  }
+
+  resp, err := tr.RoundTrip(req)
+  if err != nil {
+    return expires, err
+  }
+  defer resp.Body.Close()
+
+  expires = certExpiry(resp.TLS)
+
+  if !check.expects(resp.StatusCode) {
+    return expires, fmt.Errorf("unexpected status %s", resp.Status)
+  }
+
+  if check.Body != "" {
+    body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCheckBody))
+    if err != nil {
+      return expires, err
+    }
+
+    if !strings.Contains(string(body), check.Body) {
+      return expires, fmt.Errorf("body does not contain %q", check.Body)
+    }
+  }
+
+  return expires, nil
+}
@@ -0,0 +1,45 @@
+package knuckles
+
+import "strings"
+
+// CatchAll is the hostname of the default application
+const CatchAll = "*"
+
+// hostnameCandidates lists the entries that may resolve name, most
+// specific first: the exact name, wildcards from the longest suffix down
+// and finally the catch-all.
+func hostnameCandidates(name string) []string {
+  candidates := []string{name}
+
+  rest := name
+  for {
+    dot := strings.Index(rest, ".")
+    if dot < 0 {
+      break
+    }
+    rest = rest[dot+1:]
+    if rest == "" {
+      break
+    }
+    candidates = append(candidates, "*."+rest)
+  }
+
+  return append(candidates, CatchAll)
+}
+
+// validHostname accepts plain names, "*.suffix" wildcards and the catch-all
+func validHostname(hostname string) bool {
+  if hostname == "" {
+    return false
+  }
+
+  if hostname == CatchAll {
+    return true
+  }
+
+  if strings.HasPrefix(hostname, "*.") {
+    hostname = hostname[2:]
+  }
+
+  return hostname != "" && !strings.Contains(hostname, "*")
+}
@@ -1,17 +1,22 @@
 package knuckles
 
 import (
+  "bufio"
+  "crypto/tls"
   "fmt"
   "io"
+  "log"
   "net"
   "net/http"
   "net/url"
   "strconv"
   "strings"
+  "sync/atomic"
   "time"
 )
 
 type HTTPProxyConfig struct {
+  TLS                   bool
   XForwardedFor         bool
   XRequestStart         bool
   XForwardedProto       string
@@ -20,17 +25,83 @@ type HTTPProxyConfig struct {
   RedirectNoHostname    string
   RedirectNoBackend     string
   RedirectInternalError string
+  ErrorPageNoHostname   string
+  ErrorPageNoBackend    string
+  ErrorPageBackendError string
+  AffinityCookie        string
+  AffinitySecret        string
+  MaxIdleConnsPerHost   int
+  MaxConnsPerHost       int
+  IdleConnTimeout       time.Duration
+  Retries               int
+  EjectThreshold        int
+  EjectCooldown         time.Duration
+  AccessLog             string
+  AccessLogFormat       string
+  AccessLogSample       float64
 }
 
 type HTTPProxy struct {
-  Server   http.Server
-  listener net.Listener
-  Config   HTTPProxyConfig
+  Server         http.Server
+  listener       net.Listener
+  Config         HTTPProxyConfig
+  outstanding    *Outstanding
+  affinitySecret []byte
+  certs          *certCache
+  pool           *backendPool
+  outliers       *outlierDetector
+  events         chan Event
+  pages          *errorPages
+  redirects      map[string]string
+  accessLog      *AccessLog
+  bound          int32
 }
 
 func NewHTTPProxy(config HTTPProxyConfig) (*HTTPProxy, error) {
   h := &HTTPProxy{
-    Config: config,
+    Config:      config,
+    outstanding: NewOutstanding(),
+    certs:       newCertCache(),
+    pool:        newBackendPool(config),
+    outliers:    newOutlierDetector(config),
+    events:      make(chan Event, 64),
+    redirects: map[string]string{
+      PageNoHostname:   config.RedirectNoHostname,
+      PageNoBackend:    config.RedirectNoBackend,
+      PageBackendError: config.RedirectInternalError,
+    },
+  }
+
+  var err error
+  h.pages, err = newErrorPages(map[string]string{
+    PageNoHostname:   config.ErrorPageNoHostname,
+    PageNoBackend:    config.ErrorPageNoBackend,
+    PageBackendError: config.ErrorPageBackendError,
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  if config.AccessLog != "" {
+    h.accessLog, err = NewAccessLog(AccessLogConfig{
+      Path:   config.AccessLog,
+      Format: config.AccessLogFormat,
+      Sample: config.AccessLogSample,
+    })
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  if h.Config.AffinityCookie == "" {
+    h.Config.AffinityCookie = DefaultAffinityCookie
+  }
+
+  // without a shared secret, cookies only survive on this proxy
+  if h.Config.AffinitySecret != "" {
+    h.affinitySecret = []byte(h.Config.AffinitySecret)
+  } else {
+    h.affinitySecret = randomSecret()
   }
 
   mux := http.NewServeMux()
@@ -48,125 +119,362 @@ func (h *HTTPProxy) Start() error {
     return err
   }
 
+  if h.Config.TLS {
+    h.listener = tls.NewListener(h.listener, &tls.Config{
+      GetCertificate: h.getCertificate,
+    })
+  }
+
+  h.Config.Store.Subscribe(h.events)
+  go h.watchStore()
+
+  atomic.StoreInt32(&h.bound, 1)
+  defer atomic.StoreInt32(&h.bound, 0)
+
   return h.Server.Serve(h.listener)
 }
 
+// Bound tells whether the listener accepts connections
+func (h *HTTPProxy) Bound() bool {
+  return atomic.LoadInt32(&h.bound) == 1
+}
+
 func (h *HTTPProxy) Stop() error {
+  atomic.StoreInt32(&h.bound, 0)
+  h.Config.Store.Unsubscribe(h.events)
+  close(h.events)
+  h.pool.closeAll()
+  if h.accessLog != nil {
+    h.accessLog.Close()
+  }
   return h.listener.Close()
 }
 
+// ReopenLog reopens the access log file after it was rotated
+func (h *HTTPProxy) ReopenLog() error {
+  if h.accessLog == nil {
+    return nil
+  }
+
+  return h.accessLog.Reopen()
+}
+
+// watchStore closes the connections of backends as they get removed
+func (h *HTTPProxy) watchStore() {
+  for ev := range h.events {
+    if ev.Type == EventBackendRemoved {
+      h.pool.close(ev.App, ev.Backend)
+    }
+  }
+}
+
 func (h *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  start := time.Now()
+  entry := &AccessLogEntry{}
+  lw := &loggedResponse{ResponseWriter: w}
+
+  h.serve(lw, r, entry)
+
+  entry.Total = time.Since(start).Seconds()
+
+  // websockets are hijacked, their status and bytes are set while proxying
+  if !entry.Websocket {
+    entry.Status = lw.status
+    entry.Bytes = lw.bytes
+  }
+
+  // handlers writing nothing answer 200
+  if entry.Status == 0 {
+    entry.Status = http.StatusOK
+  }
+
+  observeRequest(entry)
+
+  if h.accessLog == nil || !h.accessLog.sampled() {
+    return
+  }
+
+  entry.Time = start
+  entry.ClientIP = clientIP(r)
+  entry.Method = r.Method
+  entry.URI = r.RequestURI
+  entry.Proto = r.Proto
+  entry.Referer = r.Referer()
+  entry.UserAgent = r.UserAgent()
+
+  h.accessLog.Log(*entry)
+}
+
+// serve proxies r, noting where it went in entry
+func (h *HTTPProxy) serve(w http.ResponseWriter, r *http.Request, entry *AccessLogEntry) {
   hostname := r.Host
 
   if sep := strings.Index(hostname, ":"); sep >= 0 {
     hostname = hostname[:sep]
   }
+  entry.Hostname = hostname
 
   // tag before starting redis queries
   if h.Config.XRequestStart {
     r.Header.Set("X-Request-Start", requestStart())
   }
 
-  if h.Config.XForwardedProto != "" {
-    r.Header.Set("X-Forwarded-Proto", h.Config.XForwardedProto)
+  // configured value wins, for listeners behind another TLS terminator
+  proto := h.Config.XForwardedProto
+  if proto == "" {
+    proto = "http"
+    if r.TLS != nil {
+      proto = "https"
+    }
   }
+  r.Header.Set("X-Forwarded-Proto", proto)
 
   if h.Config.XForwardedFor {
     r.Header.Set("X-Forwarded-For", clientIP(r))
   }
 
-  endpoint, err := h.Config.Store.EndpointForHostname(hostname)
+  ctx := &RequestContext{
+    Request:     r,
+    ClientIP:    clientIP(r),
+    Outstanding: h.outstanding,
+  }
+
+  if c, err := r.Cookie(h.Config.AffinityCookie); err == nil {
+    ctx.PinnedApp, ctx.Pinned, _ = verifyAffinity(h.affinitySecret, c.Value)
+  }
+
+  endpoint, err := h.Config.Store.EndpointForHostname(hostname, ctx)
+  entry.App = endpoint.App()
 
   if err != nil {
-    h.clientErr(w, r, err)
+    h.clientErr(w, r, endpoint.App(), err)
     return
   }
 
-  r.URL.Host = endpoint.Addr()
-  r.URL.Scheme = "http"
-
   connection := r.Header.Get("Connection")
 
   if strings.ToLower(connection) == "upgrade" {
-    h.wsProxy(w, r)
+    h.wsProxy(w, r, ctx, endpoint, entry)
   } else {
-    h.simpleProxy(w, r)
+    h.simpleProxy(w, r, ctx, hostname, endpoint, entry)
   }
 }
 
-func (h *HTTPProxy) simpleProxy(w http.ResponseWriter, r *http.Request) {
+// outgoing points a copy of r at endpoint, r is kept for retries
+func outgoing(r *http.Request, endpoint Endpoint) *http.Request {
+  out := new(http.Request)
+  *out = *r
+
+  u := *r.URL
+  out.URL = &u
+  out.URL.Host = endpoint.Addr()
+  out.URL.Scheme = "http"
+
+  if prefix := endpoint.StripPrefix(); prefix != "" {
+    out.URL.Path = stripPrefix(out.URL.Path, prefix)
+    out.URL.RawPath = ""
+  }
+
+  return out
+}
+
+// affinityCookie (re)pins the client when the app wants affinity
+func (h *HTTPProxy) affinityCookie(r *http.Request, ctx *RequestContext, endpoint Endpoint) *http.Cookie {
+  if !endpoint.Sticky() || (ctx.PinnedApp == endpoint.App() && ctx.Pinned == endpoint.Addr()) {
+    return nil
+  }
 
-  tr := &http.Transport{
-    DisableKeepAlives: true,
+  return &http.Cookie{
+    Name:     h.Config.AffinityCookie,
+    Value:    signAffinity(h.affinitySecret, endpoint.App(), endpoint.Addr()),
+    Path:     "/",
+    HttpOnly: true,
+    Secure:   r.TLS != nil,
   }
+}
 
-  resp, err := tr.RoundTrip(r)
+func (h *HTTPProxy) simpleProxy(w http.ResponseWriter, r *http.Request, ctx *RequestContext, hostname string, endpoint Endpoint, entry *AccessLogEntry) {
+  var resp *http.Response
+  var err error
 
+  body, resendable, err := bufferBody(r)
   if err != nil {
-    h.clientErr(w, r, err)
+    http.Error(w, "Bad Request", http.StatusBadRequest)
     return
   }
 
+  for attempt := 0; ; attempt++ {
+    out := outgoing(r, endpoint)
+    if body != nil {
+      withBody(out, body)
+    }
+
+    entry.Backend = endpoint.Addr()
+    sent := time.Now()
+
+    h.outstanding.Acquire(endpoint.Addr())
+    resp, err = h.pool.transport(endpoint.App(), endpoint.Addr()).RoundTrip(out)
+    entry.Upstream = time.Since(sent).Seconds()
+    if err == nil {
+      defer h.outstanding.Release(endpoint.Addr())
+      break
+    }
+    h.outstanding.Release(endpoint.Addr())
+    // a client that went away or timed out says nothing about the backend
+    if r.Context().Err() == nil {
+      h.outliers.failure(endpoint.App(), endpoint.Addr(), err.Error())
+    }
+
+    if attempt >= h.Config.Retries || !retryable(r, resendable, err) {
+      h.clientErr(w, r, endpoint.App(), err)
+      return
+    }
+
+    log.Println("Backend", endpoint.Addr(), "failed for", hostname+":", err)
+
+    if ctx.Exclude == nil {
+      ctx.Exclude = make(map[string]bool)
+    }
+    ctx.Exclude[endpoint.Addr()] = true
+
+    next, nextErr := h.Config.Store.EndpointForHostname(hostname, ctx)
+    if nextErr != nil {
+      h.clientErr(w, r, endpoint.App(), err)
+      return
+    }
+
+    log.Println("Retrying", hostname, "on", next.Addr())
+    endpoint = next
+  }
+
   defer resp.Body.Close()
 
+  if resp.StatusCode >= 500 {
+    h.outliers.failure(endpoint.App(), endpoint.Addr(), resp.Status)
+  } else {
+    h.outliers.success(endpoint.App(), endpoint.Addr())
+  }
+
   for name, values := range resp.Header {
     for _, val := range values {
       w.Header().Add(name, val)
     }
   }
 
+  if pin := h.affinityCookie(r, ctx, endpoint); pin != nil {
+    http.SetCookie(w, pin)
+  }
+
   w.WriteHeader(resp.StatusCode)
   // TODO: check copy
   io.Copy(w, resp.Body)
 }
 
-func (h *HTTPProxy) wsProxy(w http.ResponseWriter, r *http.Request) {
+func (h *HTTPProxy) wsProxy(w http.ResponseWriter, r *http.Request, ctx *RequestContext, endpoint Endpoint, entry *AccessLogEntry) {
+  entry.Backend = endpoint.Addr()
+
+  h.outstanding.Acquire(endpoint.Addr())
+  defer h.outstanding.Release(endpoint.Addr())
+
+  out := outgoing(r, endpoint)
+  pin := h.affinityCookie(r, ctx, endpoint)
+
   hj, ok := w.(http.Hijacker)
 
   if !ok {
-    h.clientErr(w, r, ErrInvalidAction)
+    h.clientErr(w, r, endpoint.App(), ErrInvalidAction)
+    return
+  }
+
+  // dial first so failures can still be answered over HTTP
+  sent := time.Now()
+  server, err := net.Dial("tcp", out.URL.Host)
+  entry.Upstream = time.Since(sent).Seconds()
+  if err != nil {
+    h.outliers.failure(endpoint.App(), endpoint.Addr(), err.Error())
+    h.clientErr(w, r, endpoint.App(), err)
     return
   }
+  defer server.Close()
+  h.outliers.success(endpoint.App(), endpoint.Addr())
 
   client, _, err := hj.Hijack()
   if err != nil {
-    h.clientErr(w, r, err)
+    h.clientErr(w, r, endpoint.App(), err)
     return
   }
   defer client.Close()
 
-  server, err := net.Dial("tcp", r.URL.Host)
+  // from here on the client only sees what the backend answers
+  entry.Websocket = true
+  entry.Status = http.StatusSwitchingProtocols
+
+  err = out.Write(server)
   if err != nil {
-    h.clientErr(w, r, err)
     return
   }
-  defer server.Close()
 
-  err = r.Write(server)
+  if pin != nil {
+    err = writeHandshake(client, server, out, pin)
+    if err != nil {
+      return
+    }
+  }
+
+  metricTunnels.add(1)
+  entry.Bytes = passBytes(client, server)
+  metricTunnels.add(-1)
+}
+
+// writeHandshake relays the upgrade response adding the affinity cookie
+func writeHandshake(client, server net.Conn, r *http.Request, pin *http.Cookie) error {
+  br := bufio.NewReader(server)
+
+  resp, err := http.ReadResponse(br, r)
   if err != nil {
-    h.clientErr(w, r, err)
-    return
+    return err
   }
 
-  go passBytes(client, server)
+  resp.Header.Add("Set-Cookie", pin.String())
+
+  err = resp.Write(client)
+  if err != nil {
+    return err
+  }
+
+  // frames the backend sent right after the handshake
+  if n := br.Buffered(); n > 0 {
+    buffered, _ := br.Peek(n)
+    _, err = client.Write(buffered)
+  }
+
+  return err
 }
 
-func passBytes(client, server net.Conn) {
-  pass := func(from, to net.Conn, done chan error) {
-    _, err := io.Copy(to, from)
+// passBytes relays both ways until either side is done, returning the
+// bytes sent to the client
+func passBytes(client, server net.Conn) int64 {
+  var sent int64
+
+  pass := func(from, to net.Conn, n *int64, done chan error) {
+    var err error
+    *n, err = io.Copy(to, from)
     done <- err
   }
 
   done := make(chan error, 2)
 
-  go pass(client, server, done)
-  go pass(server, client, done)
+  var received int64
+  go pass(client, server, &received, done)
+  go pass(server, client, &sent, done)
 
   <-done
   client.Close()
   server.Close()
   <-done
   close(done)
+
+  return sent
 }
 
 func requestStart() string {
@@ -183,20 +491,29 @@ func clientIP(r *http.Request) string {
   return raddr[0]
 }
 
-func (h *HTTPProxy) clientErr(w http.ResponseWriter, r *http.Request, inputErr error) {
-  var redirect string
+// clientErr answers with the error page of app or of the listener. A
+// listener with only a redirect configured for the page redirects there.
+func (h *HTTPProxy) clientErr(w http.ResponseWriter, r *http.Request, app string, inputErr error) {
+  kind := pageKind(inputErr)
+
+  var body string
+  if app != "" {
+    var err error
+    body, err = h.Config.Store.ErrorPageForApp(app, kind)
+    if err != nil {
+      log.Println("Failed to get", kind, "error page of", app+":", err)
+    }
+  }
+
+  if _, ok := h.pages.files[kind]; body == "" && !ok && h.redirects[kind] != "" {
+    finalURL := fmt.Sprintf("%s?err=%s", h.redirects[kind], url.QueryEscape(kind))
+    http.Redirect(w, r, finalURL, http.StatusTemporaryRedirect)
+    return
+  }
 
-  switch inputErr {
-  case ErrNoBackend:
-    redirect = h.Config.RedirectNoBackend
-  case ErrDeadBackend:
-    redirect = h.Config.RedirectNoBackend
-  case ErrNoHostname:
-    redirect = h.Config.RedirectNoHostname
-  default:
-    redirect = h.Config.RedirectInternalError
+  if kind == PageBackendError {
+    log.Println("Failed to proxy", r.Host+r.URL.Path+":", inputErr)
   }
 
-  finalURL := fmt.Sprintf("%s?err=%s", redirect, url.QueryEscape(inputErr.Error()))
-  http.Redirect(w, r, finalURL, http.StatusTemporaryRedirect)
+  h.pages.render(w, r, kind, body)
 }
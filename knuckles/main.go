@@ -9,31 +9,62 @@ import (
   "os/signal"
   "sync"
   "syscall"
+  "time"
 )
 
 type apiFormat struct {
   Address string
+  Drain   int
 }
 
 type redisFormat struct {
   Address   string
   Namespace string
+  CacheTTL  int `toml:"cache_ttl"`
 }
 
 type pingerFormat struct {
-  Redis     string
-  Namespace string
-  Interval  int
+  Redis         string
+  Namespace     string
+  Interval      int
+  Rise          int
+  Fall          int
+  FlapThreshold int `toml:"flap_threshold"`
+  FlapWindow    int `toml:"flap_window"`
+  FlapHold      int `toml:"flap_hold"`
+  Workers       int
+  MaxProbes     int `toml:"max_probes"`
+  ID            string
+  LeaseTTL      int `toml:"lease_ttl"`
+}
+
+type reaperFormat struct {
+  Interval int
 }
 
 type listenerFormat struct {
   Address         string
-  XRequestStart   bool   `toml:"x_request_start"`
-  XForwardedFor   bool   `toml:"x_forwarded_for"`
-  XForwardedProto string `toml:"x_forwarded_proto"`
-  ErrorNoBackend  string `toml:"error_no_backend"`
-  ErrorNoHostname string `toml:"error_no_hostname"`
-  ErrorInternal   string `toml:"error_internal"`
+  TLS             bool    `toml:"tls"`
+  XRequestStart   bool    `toml:"x_request_start"`
+  XForwardedFor   bool    `toml:"x_forwarded_for"`
+  XForwardedProto string  `toml:"x_forwarded_proto"`
+  ErrorNoBackend  string  `toml:"error_no_backend"`
+  ErrorNoHostname string  `toml:"error_no_hostname"`
+  ErrorInternal   string  `toml:"error_internal"`
+  PageNoHostname  string  `toml:"error_page_no_hostname"`
+  PageNoBackend   string  `toml:"error_page_no_backend"`
+  PageBackend     string  `toml:"error_page_backend_error"`
+  AffinityCookie  string  `toml:"affinity_cookie"`
+  AffinitySecret  string  `toml:"affinity_secret"`
+  MaxIdlePerHost  int     `toml:"max_idle_conns_per_host"`
+  MaxPerHost      int     `toml:"max_conns_per_host"`
+  IdleTimeout     int     `toml:"idle_conn_timeout"`
+  Retries         int     `toml:"retries"`
+  EjectThreshold  int     `toml:"eject_threshold"`
+  EjectCooldown   int     `toml:"eject_cooldown"`
+  AccessLog       string  `toml:"access_log"`
+  AccessLogFormat string  `toml:"access_log_format"`
+  AccessLogSample float64 `toml:"access_log_sample"`
 }
 
 type configFormat struct {
@@ -41,6 +72,7 @@ type configFormat struct {
   Listeners map[string]listenerFormat
   Redis     redisFormat
   Pinger    pingerFormat
+  Reaper    reaperFormat
 }
 
 var configFile = flag.String("config", "/etc/knuckles.conf", "Configuration File")
@@ -49,7 +81,7 @@ var proxy *knuckles.HTTPProxy
 func main() {
   var err error
   var wg sync.WaitGroup
-  var proxies []*knuckles.HTTPProxy
+  proxies := make(map[string]*knuckles.HTTPProxy)
   var pinger *knuckles.Pinger
 
   flag.Parse()
@@ -68,27 +100,60 @@ func main() {
     os.Exit(1)
   }
 
-  store, err := knuckles.NewRedisStore(config.Redis.Namespace, config.Redis.Address)
+  var store knuckles.Store
+
+  if config.Redis.Address != "" {
+    var redisStore *knuckles.RedisStore
+    redisStore, err = knuckles.NewRedisStore(config.Redis.Namespace, config.Redis.Address)
+    if err == nil && config.Redis.CacheTTL > 0 {
+      log.Println("Caching resolution for up to", config.Redis.CacheTTL, "seconds")
+      redisStore.EnableCache(time.Duration(config.Redis.CacheTTL) * time.Second)
+    }
+    store = redisStore
+  } else {
+    log.Println("No redis address, using in-memory store")
+    store = knuckles.NewMemoryStore()
+  }
 
   if err != nil {
     log.Println(err)
     os.Exit(1)
   }
 
-  apiConfig := knuckles.HTTPAPIConfig{}
-  apiConfig.Addr = config.Api.Address
-  apiConfig.Store = store
+  // store calls are timed for /metrics
+  store = knuckles.NewMeteredStore(store)
 
-  api, err := knuckles.NewHTTPAPI(apiConfig)
+  // the in-memory store can only be checked by a pinger in this process
+  var pingerStore knuckles.Store
+
+  if config.Pinger.Redis != "" {
+    var redisStore *knuckles.RedisStore
+    redisStore, err = knuckles.NewRedisStore(config.Pinger.Namespace, config.Pinger.Redis)
+    pingerStore = knuckles.NewMeteredStore(redisStore)
+  } else if config.Redis.Address == "" && config.Pinger.Interval > 0 {
+    pingerStore = store
+  }
 
   if err != nil {
     log.Println(err)
     os.Exit(1)
   }
 
-  if config.Pinger.Redis != "" {
+  if pingerStore != nil {
     log.Println("Starting PING service")
-    pinger, err = knuckles.NewPinger(config.Pinger.Namespace, config.Pinger.Redis, config.Pinger.Interval)
+    pinger, err = knuckles.NewPinger(knuckles.PingerConfig{
+      Store:         pingerStore,
+      Interval:      config.Pinger.Interval,
+      Rise:          config.Pinger.Rise,
+      Fall:          config.Pinger.Fall,
+      FlapThreshold: config.Pinger.FlapThreshold,
+      FlapWindow:    time.Duration(config.Pinger.FlapWindow) * time.Second,
+      FlapHold:      time.Duration(config.Pinger.FlapHold) * time.Second,
+      Workers:       config.Pinger.Workers,
+      MaxProbes:     config.Pinger.MaxProbes,
+      ID:            config.Pinger.ID,
+      LeaseTTL:      time.Duration(config.Pinger.LeaseTTL) * time.Second,
+    })
     if err != nil {
       log.Println(err)
       os.Exit(1)
@@ -96,17 +161,43 @@ func main() {
     wg.Add(1)
   }
 
+  // removes expired backends, several proxies reaping the same store is fine
+  reaper, err := knuckles.NewReaper(knuckles.ReaperConfig{
+    Store:    store,
+    Interval: time.Duration(config.Reaper.Interval) * time.Second,
+  })
+
+  if err != nil {
+    log.Println(err)
+    os.Exit(1)
+  }
+
   for lName, lF := range config.Listeners {
 
     lConf := knuckles.HTTPProxyConfig{
       Store:                 store,
       Addr:                  lF.Address,
+      TLS:                   lF.TLS,
       XForwardedFor:         lF.XForwardedFor,
       XForwardedProto:       lF.XForwardedProto,
       XRequestStart:         lF.XRequestStart,
       RedirectNoHostname:    lF.ErrorNoHostname,
       RedirectNoBackend:     lF.ErrorNoBackend,
       RedirectInternalError: lF.ErrorInternal,
+      ErrorPageNoHostname:   lF.PageNoHostname,
+      ErrorPageNoBackend:    lF.PageNoBackend,
+      ErrorPageBackendError: lF.PageBackend,
+      AffinityCookie:        lF.AffinityCookie,
+      AffinitySecret:        lF.AffinitySecret,
+      MaxIdleConnsPerHost:   lF.MaxIdlePerHost,
+      MaxConnsPerHost:       lF.MaxPerHost,
+      IdleConnTimeout:       time.Duration(lF.IdleTimeout) * time.Second,
+      Retries:               lF.Retries,
+      EjectThreshold:        lF.EjectThreshold,
+      EjectCooldown:         time.Duration(lF.EjectCooldown) * time.Second,
+      AccessLog:             lF.AccessLog,
+      AccessLogFormat:       lF.AccessLogFormat,
+      AccessLogSample:       lF.AccessLogSample,
     }
 
     listener, err := knuckles.NewHTTPProxy(lConf)
@@ -118,30 +209,67 @@ func main() {
 
     log.Println("Adding listener", lName, lF.Address)
 
-    proxies = append(proxies, listener)
+    proxies[lName] = listener
+  }
+
+  apiConfig := knuckles.HTTPAPIConfig{}
+  apiConfig.Addr = config.Api.Address
+  apiConfig.Store = store
+  apiConfig.Pinger = pinger
+  apiConfig.Reaper = reaper
+  apiConfig.Proxies = proxies
+
+  api, err := knuckles.NewHTTPAPI(apiConfig)
+
+  if err != nil {
+    log.Println(err)
+    os.Exit(1)
   }
 
   // terminate on ctrl+c or via kill
-  signalC := make(chan os.Signal)
+  signalC := make(chan os.Signal, 1)
   signal.Notify(signalC, os.Interrupt, syscall.SIGTERM)
   go func() {
     <-signalC
+
+    // readiness fails first, so load balancers move traffic away
+    api.Drain()
+    if config.Api.Drain > 0 {
+      log.Println("Draining for", config.Api.Drain, "seconds")
+      time.Sleep(time.Duration(config.Api.Drain) * time.Second)
+    }
+
     for _, proxy := range proxies {
       proxy.Stop()
     }
     api.Stop()
+    reaper.Stop()
     wg.Done()
 
-    if config.Pinger.Redis != "" {
+    if pinger != nil {
       pinger.Stop()
       wg.Done()
     }
 
   }()
 
+  // reopen access logs once logrotate moved them away
+  hupC := make(chan os.Signal, 1)
+  signal.Notify(hupC, syscall.SIGHUP)
+  go func() {
+    for _ = range hupC {
+      for _, proxy := range proxies {
+        err := proxy.ReopenLog()
+        if err != nil {
+          log.Println("Failed to reopen access log:", err)
+        }
+      }
+    }
+  }()
+
   for _, proxy := range proxies {
+    wg.Add(1)
     go func(p *knuckles.HTTPProxy) {
-      wg.Add(1)
       p.Start()
       wg.Done()
     }(proxy)
@@ -150,7 +278,9 @@ func main() {
   wg.Add(1)
   go api.Start()
 
-  if config.Pinger.Redis != "" {
+  go reaper.Start()
+
+  if pinger != nil {
     go pinger.Start()
   }
 
@@ -0,0 +1,933 @@
+package knuckles
+
+import (
+  "sort"
+  "sync"
+  "time"
+)
+
+type memoryLease struct {
+  owner   string
+  expires time.Time
+}
+
+type memoryApp struct {
+  name      string
+  hostnames map[string]bool
+  backends  map[string]bool
+  live      map[string]bool
+  ttl       map[string]int
+  ttlSecs   map[string]int
+  weights   map[string]int
+  ejections map[string]Ejection
+  health    map[string]HealthState
+  strategy  Strategy
+  affinity  bool
+  check     HealthCheck
+  pages     map[string]string
+}
+
+// MemoryStore keeps the whole configuration in process memory.
+// Useful for tests and single-node deployments without Redis.
+type MemoryStore struct {
+  mu       sync.Mutex
+  apps     map[string]*memoryApp
+  resolve  map[string]string
+  routes   map[string][]Route
+  certs    map[string][2]string
+  leases   map[string]memoryLease
+  groups   map[string]map[string]time.Time
+  balancer *Balancer
+
+  subscribers eventSubscribers
+}
+
+func NewMemoryStore() *MemoryStore {
+  return &MemoryStore{
+    apps:     make(map[string]*memoryApp),
+    resolve:  make(map[string]string),
+    routes:   make(map[string][]Route),
+    certs:    make(map[string][2]string),
+    leases:   make(map[string]memoryLease),
+    groups:   make(map[string]map[string]time.Time),
+    balancer: NewBalancer(),
+  }
+}
+
+func newMemoryApp(name string) *memoryApp {
+  return &memoryApp{
+    name:      name,
+    hostnames: make(map[string]bool),
+    backends:  make(map[string]bool),
+    live:      make(map[string]bool),
+    ttl:       make(map[string]int),
+    ttlSecs:   make(map[string]int),
+    weights:   make(map[string]int),
+    ejections: make(map[string]Ejection),
+    health:    make(map[string]HealthState),
+    strategy:  DefaultStrategy(),
+    check:     DefaultHealthCheck(),
+    pages:     make(map[string]string),
+  }
+}
+
+func (m *MemoryStore) EndpointForHostname(name string, ctx *RequestContext) (Endpoint, error) {
+  var epoint Endpoint
+
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  var appName string
+  path := requestPath(ctx)
+
+  for _, c := range hostnameCandidates(name) {
+    if rt, ok := longestRoute(m.routes[c], path); ok {
+      appName = rt.App
+      if rt.Strip {
+        epoint.strip = rt.Prefix
+      }
+      break
+    }
+
+    if app, ok := m.resolve[c]; ok {
+      appName = app
+      break
+    }
+  }
+
+  if appName == "" {
+    return epoint, ErrNoHostname
+  }
+
+  // known even without backends, for the error page
+  epoint.app = appName
+
+  a, ok := m.apps[appName]
+  if !ok {
+    return epoint, ErrNoBackend
+  }
+
+  live := candidates(unexpired(sortedKeys(a.live), a.ttl, time.Now()), ctx)
+  if len(live) == 0 {
+    return epoint, ErrNoBackend
+  }
+
+  epoint.sticky = a.affinity
+
+  if a.affinity {
+    if pinned, ok := pinnedBackend(appName, live, ctx); ok {
+      epoint.addr = pinned
+      return epoint, nil
+    }
+  }
+
+  var err error
+  epoint.addr, err = m.balancer.Pick(appName, a.strategy, live, a.weights, ctx)
+
+  return epoint, err
+}
+
+func (m *MemoryStore) AddApplication(app string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  if _, ok := m.apps[app]; ok {
+    return ErrAppAlreadyExists
+  }
+
+  m.apps[app] = newMemoryApp(app)
+  m.notify(Event{Type: EventApplicationAdded, App: app})
+
+  return nil
+}
+
+func (m *MemoryStore) getApp(app string) (*memoryApp, error) {
+  a, ok := m.apps[app]
+  if !ok {
+    return nil, ErrNoApp
+  }
+
+  return a, nil
+}
+
+func (m *MemoryStore) isValidBackend(a *memoryApp, backend string) error {
+  if !a.backends[backend] {
+    return ErrNoBackend
+  }
+
+  // same lazy ttl expiration as RedisStore
+  if ttl, ok := a.ttl[backend]; ok {
+    if expired(ttl, time.Now()) {
+      old := liveState(a.live[backend])
+      m.removeBackend(a, backend)
+      m.notify(Event{Type: EventBackendRemoved, App: a.name, Backend: backend, Old: old, Reason: "ttl expired"})
+      return ErrNoBackend
+    }
+  }
+
+  return nil
+}
+
+func (m *MemoryStore) EnableBackend(app, backend, reason string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  err = m.isValidBackend(a, backend)
+  if err != nil {
+    return err
+  }
+
+  if e, ok := a.ejections[backend]; ok && e.Active() {
+    return ErrBackendEjected
+  }
+
+  if !a.live[backend] {
+    a.live[backend] = true
+    m.notify(Event{Type: EventBackendEnabled, App: app, Backend: backend, Old: StateDead, New: StateLive, Reason: reason})
+  }
+
+  return nil
+}
+
+func (m *MemoryStore) DisableBackend(app, backend, reason string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  err = m.isValidBackend(a, backend)
+  if err != nil {
+    return err
+  }
+
+  if a.live[backend] {
+    delete(a.live, backend)
+    m.notify(Event{Type: EventBackendDisabled, App: app, Backend: backend, Old: StateLive, New: StateDead, Reason: reason})
+  }
+
+  return nil
+}
+
+func (m *MemoryStore) EjectBackend(app, backend, reason string, cooldown time.Duration) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  err = m.isValidBackend(a, backend)
+  if err != nil {
+    return err
+  }
+
+  a.ejections[backend] = Ejection{Reason: reason, Until: time.Now().Add(cooldown)}
+  old := liveState(a.live[backend])
+  delete(a.live, backend)
+  m.notify(Event{Type: EventBackendEjected, App: app, Backend: backend, Old: old, New: StateDead, Reason: reason})
+
+  return nil
+}
+
+func (m *MemoryStore) BackendHealth(app, backend string) (HealthState, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, ok := m.apps[app]
+  if !ok {
+    return HealthState{}, nil
+  }
+
+  return a.health[backend], nil
+}
+
+func (m *MemoryStore) SetBackendHealth(app, backend string, state HealthState) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  err = m.isValidBackend(a, backend)
+  if err != nil {
+    return err
+  }
+
+  a.health[backend] = state
+
+  return nil
+}
+
+func (m *MemoryStore) AddHostname(app, hostname string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  if !validHostname(hostname) {
+    return ErrInvalidHostname
+  }
+
+  if _, ok := m.resolve[hostname]; ok {
+    return ErrHostnameAlreadyExists
+  }
+
+  m.resolve[hostname] = app
+  a.hostnames[hostname] = true
+  m.notify(Event{Type: EventHostnameAdded, App: app, Hostname: hostname})
+
+  return nil
+}
+
+func (m *MemoryStore) AddBackend(app, backend string, ttl, weight int) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  if ttl > 0 {
+    a.ttl[backend] = int(time.Now().Unix()) + ttl
+    a.ttlSecs[backend] = ttl
+  }
+
+  if weight > 0 {
+    a.weights[backend] = weight
+  } else if _, ok := a.weights[backend]; !ok {
+    a.weights[backend] = DefaultWeight
+  }
+
+  added := !a.backends[backend]
+  a.backends[backend] = true
+  m.notify(Event{Type: EventBackendAdded, App: app, Backend: backend})
+
+  if !added {
+    return nil
+  }
+
+  // ejected backends are registered but stay out until the cooldown is over
+  if e, ok := a.ejections[backend]; ok && e.Active() {
+    return nil
+  }
+
+  if !a.live[backend] {
+    a.live[backend] = true
+    m.notify(Event{Type: EventBackendEnabled, App: app, Backend: backend, Old: StateDead, New: StateLive, Reason: "added"})
+  }
+
+  return nil
+}
+
+func (m *MemoryStore) RenewBackend(app, backend string, ttl int) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  err = m.isValidBackend(a, backend)
+  if err != nil {
+    return err
+  }
+
+  if ttl <= 0 {
+    ttl = a.ttlSecs[backend]
+    if ttl <= 0 {
+      return ErrNoTTL
+    }
+  }
+
+  a.ttl[backend] = int(time.Now().Unix()) + ttl
+  a.ttlSecs[backend] = ttl
+
+  return nil
+}
+
+func (m *MemoryStore) SetBackendWeight(app, backend string, weight int) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  if weight <= 0 {
+    return ErrInvalidWeight
+  }
+
+  err = m.isValidBackend(a, backend)
+  if err != nil {
+    return err
+  }
+
+  a.weights[backend] = weight
+  m.notify(Event{Type: EventBackendWeight, App: app, Backend: backend})
+
+  return nil
+}
+
+func (m *MemoryStore) HostnamesForApp(app string) ([]string, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, ok := m.apps[app]
+  if !ok {
+    return nil, nil
+  }
+
+  return sortedKeys(a.hostnames), nil
+}
+
+func (m *MemoryStore) BackendsForApp(app string) ([]string, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, ok := m.apps[app]
+  if !ok {
+    return nil, nil
+  }
+
+  return sortedKeys(a.backends), nil
+}
+
+func (m *MemoryStore) removeBackend(a *memoryApp, backend string) {
+  delete(a.ttl, backend)
+  delete(a.ttlSecs, backend)
+  delete(a.weights, backend)
+  delete(a.ejections, backend)
+  delete(a.health, backend)
+  delete(a.live, backend)
+  delete(a.backends, backend)
+}
+
+func (m *MemoryStore) RemoveBackend(app, backend string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  if !a.backends[backend] {
+    return ErrNoBackend
+  }
+
+  old := liveState(a.live[backend])
+  m.removeBackend(a, backend)
+  m.notify(Event{Type: EventBackendRemoved, App: app, Backend: backend, Old: old})
+
+  return nil
+}
+
+func (m *MemoryStore) RemoveHostname(app, hostname string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  if !a.hostnames[hostname] && m.resolve[hostname] != app {
+    return ErrNoHostname
+  }
+
+  delete(a.hostnames, hostname)
+  if m.resolve[hostname] == app {
+    delete(m.resolve, hostname)
+  }
+  m.notify(Event{Type: EventHostnameRemoved, App: app, Hostname: hostname})
+
+  return nil
+}
+
+func (m *MemoryStore) RemoveApplication(app string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  for h, _ := range a.hostnames {
+    if m.resolve[h] == app {
+      delete(m.resolve, h)
+    }
+  }
+
+  for hostname, routes := range m.routes {
+    m.routes[hostname] = appRoutes(routes, app, false)
+    if len(m.routes[hostname]) == 0 {
+      delete(m.routes, hostname)
+    }
+  }
+
+  for backend, _ := range a.backends {
+    m.notify(Event{Type: EventBackendRemoved, App: app, Backend: backend, Old: liveState(a.live[backend])})
+  }
+
+  delete(m.apps, app)
+  m.notify(Event{Type: EventApplicationRemoved, App: app})
+
+  return nil
+}
+
+func (m *MemoryStore) SetStrategy(app string, strategy Strategy) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  err = strategy.Validate()
+  if err != nil {
+    return err
+  }
+
+  a.strategy = strategy
+  m.notify(Event{Type: EventSettings, App: app})
+
+  return nil
+}
+
+func (m *MemoryStore) StrategyForApp(app string) (Strategy, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, ok := m.apps[app]
+  if !ok {
+    return DefaultStrategy(), nil
+  }
+
+  return a.strategy, nil
+}
+
+func (m *MemoryStore) SetAffinity(app string, enabled bool) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  a.affinity = enabled
+  m.notify(Event{Type: EventSettings, App: app})
+
+  return nil
+}
+
+func (m *MemoryStore) AffinityForApp(app string) (bool, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, ok := m.apps[app]
+  if !ok {
+    return false, nil
+  }
+
+  return a.affinity, nil
+}
+
+func (m *MemoryStore) SetHealthCheck(app string, check HealthCheck) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  err = check.Validate()
+  if err != nil {
+    return err
+  }
+
+  a.check = check
+  m.notify(Event{Type: EventSettings, App: app})
+
+  return nil
+}
+
+func (m *MemoryStore) HealthCheckForApp(app string) (HealthCheck, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, ok := m.apps[app]
+  if !ok {
+    return DefaultHealthCheck(), nil
+  }
+
+  return a.check, nil
+}
+
+func (m *MemoryStore) SetErrorPage(app, kind, body string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  err = validErrorPage(kind, body)
+  if err != nil {
+    return err
+  }
+
+  a.pages[kind] = body
+  m.notify(Event{Type: EventSettings, App: app})
+
+  return nil
+}
+
+func (m *MemoryStore) RemoveErrorPage(app, kind string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  if _, ok := a.pages[kind]; !ok {
+    return ErrNoErrorPage
+  }
+
+  delete(a.pages, kind)
+  m.notify(Event{Type: EventSettings, App: app})
+
+  return nil
+}
+
+func (m *MemoryStore) ErrorPageForApp(app, kind string) (string, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, ok := m.apps[app]
+  if !ok {
+    return "", nil
+  }
+
+  return a.pages[kind], nil
+}
+
+func (m *MemoryStore) AddRoute(app, hostname, prefix string, strip bool) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  _, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  if !validHostname(hostname) {
+    return ErrInvalidHostname
+  }
+
+  if !validPrefix(prefix) {
+    return ErrInvalidPrefix
+  }
+
+  for _, rt := range m.routes[hostname] {
+    if rt.Prefix == prefix {
+      return ErrRouteAlreadyExists
+    }
+  }
+
+  m.routes[hostname] = append(m.routes[hostname], Route{Hostname: hostname, Prefix: prefix, App: app, Strip: strip})
+  m.notify(Event{Type: EventRouteAdded, App: app, Hostname: hostname})
+
+  return nil
+}
+
+func (m *MemoryStore) RemoveRoute(app, hostname, prefix string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  _, err := m.getApp(app)
+  if err != nil {
+    return err
+  }
+
+  var kept []Route
+  found := false
+  for _, rt := range m.routes[hostname] {
+    if rt.Prefix == prefix && rt.App == app {
+      found = true
+    } else {
+      kept = append(kept, rt)
+    }
+  }
+
+  if !found {
+    return ErrNoRoute
+  }
+
+  if len(kept) == 0 {
+    delete(m.routes, hostname)
+  } else {
+    m.routes[hostname] = kept
+  }
+
+  m.notify(Event{Type: EventRouteRemoved, App: app, Hostname: hostname})
+
+  return nil
+}
+
+func (m *MemoryStore) RoutesForApp(app string) ([]Route, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  var routes []Route
+  for _, hostRoutes := range m.routes {
+    routes = append(routes, appRoutes(hostRoutes, app, true)...)
+  }
+
+  return routes, nil
+}
+
+// appRoutes filters routes by whether they belong to app
+func appRoutes(routes []Route, app string, belong bool) []Route {
+  var filtered []Route
+  for _, rt := range routes {
+    if (rt.App == app) == belong {
+      filtered = append(filtered, rt)
+    }
+  }
+
+  return filtered
+}
+
+func (m *MemoryStore) SetCertificate(hostname, cert, key string) error {
+  if !validHostname(hostname) {
+    return ErrInvalidHostname
+  }
+
+  err := validCertificate(cert, key)
+  if err != nil {
+    return err
+  }
+
+  m.mu.Lock()
+  m.certs[hostname] = [2]string{cert, key}
+  m.notify(Event{Type: EventCertificateAdded, Hostname: hostname})
+  m.mu.Unlock()
+
+  return nil
+}
+
+func (m *MemoryStore) RemoveCertificate(hostname string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  if _, ok := m.certs[hostname]; !ok {
+    return ErrNoCertificate
+  }
+
+  delete(m.certs, hostname)
+  m.notify(Event{Type: EventCertificateRemoved, Hostname: hostname})
+
+  return nil
+}
+
+func (m *MemoryStore) CertificateForHostname(name string) (string, string, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  for _, c := range hostnameCandidates(name) {
+    if pair, ok := m.certs[c]; ok {
+      return pair[0], pair[1], nil
+    }
+  }
+
+  return "", "", ErrNoCertificate
+}
+
+func (m *MemoryStore) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  now := time.Now()
+
+  if l, ok := m.leases[name]; ok && l.owner != owner && now.Before(l.expires) {
+    return false, nil
+  }
+
+  m.leases[name] = memoryLease{owner: owner, expires: now.Add(ttl)}
+
+  return true, nil
+}
+
+func (m *MemoryStore) JoinGroup(group, member string, ttl time.Duration) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  if m.groups[group] == nil {
+    m.groups[group] = make(map[string]time.Time)
+  }
+  m.groups[group][member] = time.Now().Add(ttl)
+
+  return nil
+}
+
+func (m *MemoryStore) LeaveGroup(group, member string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  delete(m.groups[group], member)
+
+  return nil
+}
+
+func (m *MemoryStore) GroupMembers(group string) ([]string, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  members := []string{}
+  now := time.Now()
+
+  for member, expires := range m.groups[group] {
+    if now.Before(expires) {
+      members = append(members, member)
+    } else {
+      delete(m.groups[group], member)
+    }
+  }
+  sort.Strings(members)
+
+  return members, nil
+}
+
+func (m *MemoryStore) ReleaseLease(name, owner string) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  if l, ok := m.leases[name]; ok && l.owner == owner {
+    delete(m.leases, name)
+  }
+
+  return nil
+}
+
+func (m *MemoryStore) Subscribe(ch chan Event) {
+  m.subscribers.add(ch)
+}
+
+func (m *MemoryStore) Unsubscribe(ch chan Event) {
+  m.subscribers.remove(ch)
+}
+
+func (m *MemoryStore) ReapBackends() (int, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  now := time.Now()
+  reaped := 0
+
+  for _, a := range m.apps {
+    for backend, ttl := range a.ttl {
+      if !expired(ttl, now) {
+        continue
+      }
+
+      old := liveState(a.live[backend])
+      m.removeBackend(a, backend)
+      m.notify(Event{Type: EventBackendRemoved, App: a.name, Backend: backend, Old: old, Reason: "ttl expired"})
+      reaped++
+    }
+  }
+
+  return reaped, nil
+}
+
+func (m *MemoryStore) Ping() error {
+  return nil
+}
+
+func (m *MemoryStore) ListApplications() ([]string, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  apps := make([]string, 0, len(m.apps))
+  for app, _ := range m.apps {
+    apps = append(apps, app)
+  }
+  sort.Strings(apps)
+
+  return apps, nil
+}
+
+func (m *MemoryStore) CountBackends() (map[string]BackendCount, error) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  counts := make(map[string]BackendCount)
+  for name, a := range m.apps {
+    counts[name] = BackendCount{Total: len(a.backends), Live: len(a.live)}
+  }
+
+  return counts, nil
+}
+
+func (m *MemoryStore) DescribeApplication(app string) ([]string, map[string]BackendInfo, error) {
+  var hostnames []string
+  var backends = make(map[string]BackendInfo)
+
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  a, err := m.getApp(app)
+  if err != nil {
+    return hostnames, backends, err
+  }
+
+  hostnames = sortedKeys(a.hostnames)
+  for backend, _ := range a.backends {
+    info := BackendInfo{
+      Alive:       a.live[backend],
+      Weight:      weightOf(a.weights, backend),
+      Flapping:    a.health[backend].Flapping(),
+      CertExpires: a.health[backend].certExpires(),
+    }
+    if e, ok := a.ejections[backend]; ok {
+      info.Ejection = &e
+    }
+    backends[backend] = info
+  }
+
+  return hostnames, backends, nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+  keys := make([]string, 0, len(set))
+  for k, _ := range set {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+
+  return keys
+}
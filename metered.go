@@ -0,0 +1,227 @@
+package knuckles
+
+import "time"
+
+// MeteredStore times the calls to a Store and counts their errors for
+// the /metrics endpoint
+type MeteredStore struct {
+  Store
+}
+
+func NewMeteredStore(store Store) *MeteredStore {
+  return &MeteredStore{Store: store}
+}
+
+// CacheStats are those of the underlying store, if it caches
+func (s *MeteredStore) CacheStats() CacheStats {
+  if cs, ok := s.Store.(cacheStats); ok {
+    return cs.CacheStats()
+  }
+
+  return CacheStats{}
+}
+
+func (s *MeteredStore) EndpointForHostname(name string, ctx *RequestContext) (epoint Endpoint, err error) {
+  defer observeStoreCall("EndpointForHostname", time.Now(), &err)
+  return s.Store.EndpointForHostname(name, ctx)
+}
+
+func (s *MeteredStore) AddApplication(app string) (err error) {
+  defer observeStoreCall("AddApplication", time.Now(), &err)
+  return s.Store.AddApplication(app)
+}
+
+func (s *MeteredStore) AddHostname(app, hostname string) (err error) {
+  defer observeStoreCall("AddHostname", time.Now(), &err)
+  return s.Store.AddHostname(app, hostname)
+}
+
+func (s *MeteredStore) AddBackend(app, backend string, ttl, weight int) (err error) {
+  defer observeStoreCall("AddBackend", time.Now(), &err)
+  return s.Store.AddBackend(app, backend, ttl, weight)
+}
+
+func (s *MeteredStore) RenewBackend(app, backend string, ttl int) (err error) {
+  defer observeStoreCall("RenewBackend", time.Now(), &err)
+  return s.Store.RenewBackend(app, backend, ttl)
+}
+
+func (s *MeteredStore) SetBackendWeight(app, backend string, weight int) (err error) {
+  defer observeStoreCall("SetBackendWeight", time.Now(), &err)
+  return s.Store.SetBackendWeight(app, backend, weight)
+}
+
+func (s *MeteredStore) EnableBackend(app, backend, reason string) (err error) {
+  defer observeStoreCall("EnableBackend", time.Now(), &err)
+  return s.Store.EnableBackend(app, backend, reason)
+}
+
+func (s *MeteredStore) DisableBackend(app, backend, reason string) (err error) {
+  defer observeStoreCall("DisableBackend", time.Now(), &err)
+  return s.Store.DisableBackend(app, backend, reason)
+}
+
+func (s *MeteredStore) EjectBackend(app, backend, reason string, cooldown time.Duration) (err error) {
+  defer observeStoreCall("EjectBackend", time.Now(), &err)
+  return s.Store.EjectBackend(app, backend, reason, cooldown)
+}
+
+func (s *MeteredStore) BackendHealth(app, backend string) (state HealthState, err error) {
+  defer observeStoreCall("BackendHealth", time.Now(), &err)
+  return s.Store.BackendHealth(app, backend)
+}
+
+func (s *MeteredStore) SetBackendHealth(app, backend string, state HealthState) (err error) {
+  defer observeStoreCall("SetBackendHealth", time.Now(), &err)
+  return s.Store.SetBackendHealth(app, backend, state)
+}
+
+func (s *MeteredStore) HostnamesForApp(app string) (hostnames []string, err error) {
+  defer observeStoreCall("HostnamesForApp", time.Now(), &err)
+  return s.Store.HostnamesForApp(app)
+}
+
+func (s *MeteredStore) BackendsForApp(app string) (backends []string, err error) {
+  defer observeStoreCall("BackendsForApp", time.Now(), &err)
+  return s.Store.BackendsForApp(app)
+}
+
+func (s *MeteredStore) RemoveApplication(name string) (err error) {
+  defer observeStoreCall("RemoveApplication", time.Now(), &err)
+  return s.Store.RemoveApplication(name)
+}
+
+func (s *MeteredStore) RemoveHostname(app, hostname string) (err error) {
+  defer observeStoreCall("RemoveHostname", time.Now(), &err)
+  return s.Store.RemoveHostname(app, hostname)
+}
+
+func (s *MeteredStore) RemoveBackend(app, backend string) (err error) {
+  defer observeStoreCall("RemoveBackend", time.Now(), &err)
+  return s.Store.RemoveBackend(app, backend)
+}
+
+func (s *MeteredStore) SetStrategy(app string, strategy Strategy) (err error) {
+  defer observeStoreCall("SetStrategy", time.Now(), &err)
+  return s.Store.SetStrategy(app, strategy)
+}
+
+func (s *MeteredStore) StrategyForApp(app string) (strategy Strategy, err error) {
+  defer observeStoreCall("StrategyForApp", time.Now(), &err)
+  return s.Store.StrategyForApp(app)
+}
+
+func (s *MeteredStore) SetAffinity(app string, enabled bool) (err error) {
+  defer observeStoreCall("SetAffinity", time.Now(), &err)
+  return s.Store.SetAffinity(app, enabled)
+}
+
+func (s *MeteredStore) AffinityForApp(app string) (enabled bool, err error) {
+  defer observeStoreCall("AffinityForApp", time.Now(), &err)
+  return s.Store.AffinityForApp(app)
+}
+
+func (s *MeteredStore) SetHealthCheck(app string, check HealthCheck) (err error) {
+  defer observeStoreCall("SetHealthCheck", time.Now(), &err)
+  return s.Store.SetHealthCheck(app, check)
+}
+
+func (s *MeteredStore) HealthCheckForApp(app string) (check HealthCheck, err error) {
+  defer observeStoreCall("HealthCheckForApp", time.Now(), &err)
+  return s.Store.HealthCheckForApp(app)
+}
+
+func (s *MeteredStore) SetErrorPage(app, kind, body string) (err error) {
+  defer observeStoreCall("SetErrorPage", time.Now(), &err)
+  return s.Store.SetErrorPage(app, kind, body)
+}
+
+func (s *MeteredStore) RemoveErrorPage(app, kind string) (err error) {
+  defer observeStoreCall("RemoveErrorPage", time.Now(), &err)
+  return s.Store.RemoveErrorPage(app, kind)
+}
+
+func (s *MeteredStore) ErrorPageForApp(app, kind string) (body string, err error) {
+  defer observeStoreCall("ErrorPageForApp", time.Now(), &err)
+  return s.Store.ErrorPageForApp(app, kind)
+}
+
+func (s *MeteredStore) AddRoute(app, hostname, prefix string, strip bool) (err error) {
+  defer observeStoreCall("AddRoute", time.Now(), &err)
+  return s.Store.AddRoute(app, hostname, prefix, strip)
+}
+
+func (s *MeteredStore) RemoveRoute(app, hostname, prefix string) (err error) {
+  defer observeStoreCall("RemoveRoute", time.Now(), &err)
+  return s.Store.RemoveRoute(app, hostname, prefix)
+}
+
+func (s *MeteredStore) RoutesForApp(app string) (routes []Route, err error) {
+  defer observeStoreCall("RoutesForApp", time.Now(), &err)
+  return s.Store.RoutesForApp(app)
+}
+
+func (s *MeteredStore) SetCertificate(hostname, cert, key string) (err error) {
+  defer observeStoreCall("SetCertificate", time.Now(), &err)
+  return s.Store.SetCertificate(hostname, cert, key)
+}
+
+func (s *MeteredStore) RemoveCertificate(hostname string) (err error) {
+  defer observeStoreCall("RemoveCertificate", time.Now(), &err)
+  return s.Store.RemoveCertificate(hostname)
+}
+
+func (s *MeteredStore) CertificateForHostname(name string) (cert, key string, err error) {
+  defer observeStoreCall("CertificateForHostname", time.Now(), &err)
+  return s.Store.CertificateForHostname(name)
+}
+
+func (s *MeteredStore) AcquireLease(name, owner string, ttl time.Duration) (ok bool, err error) {
+  defer observeStoreCall("AcquireLease", time.Now(), &err)
+  return s.Store.AcquireLease(name, owner, ttl)
+}
+
+func (s *MeteredStore) ReleaseLease(name, owner string) (err error) {
+  defer observeStoreCall("ReleaseLease", time.Now(), &err)
+  return s.Store.ReleaseLease(name, owner)
+}
+
+func (s *MeteredStore) JoinGroup(group, member string, ttl time.Duration) (err error) {
+  defer observeStoreCall("JoinGroup", time.Now(), &err)
+  return s.Store.JoinGroup(group, member, ttl)
+}
+
+func (s *MeteredStore) LeaveGroup(group, member string) (err error) {
+  defer observeStoreCall("LeaveGroup", time.Now(), &err)
+  return s.Store.LeaveGroup(group, member)
+}
+
+func (s *MeteredStore) GroupMembers(group string) (members []string, err error) {
+  defer observeStoreCall("GroupMembers", time.Now(), &err)
+  return s.Store.GroupMembers(group)
+}
+
+func (s *MeteredStore) ReapBackends() (reaped int, err error) {
+  defer observeStoreCall("ReapBackends", time.Now(), &err)
+  return s.Store.ReapBackends()
+}
+
+func (s *MeteredStore) ListApplications() (apps []string, err error) {
+  defer observeStoreCall("ListApplications", time.Now(), &err)
+  return s.Store.ListApplications()
+}
+
+func (s *MeteredStore) DescribeApplication(app string) (hostnames []string, backends map[string]BackendInfo, err error) {
+  defer observeStoreCall("DescribeApplication", time.Now(), &err)
+  return s.Store.DescribeApplication(app)
+}
+
+func (s *MeteredStore) Ping() (err error) {
+  defer observeStoreCall("Ping", time.Now(), &err)
+  return s.Store.Ping()
+}
+
+func (s *MeteredStore) CountBackends() (counts map[string]BackendCount, err error) {
+  defer observeStoreCall("CountBackends", time.Now(), &err)
+  return s.Store.CountBackends()
+}
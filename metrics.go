@@ -0,0 +1,207 @@
+package knuckles
+
+import (
+  "fmt"
+  "io"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// DefaultBuckets are the upper bounds of latency histograms, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+  metricCounter   = "counter"
+  metricGauge     = "gauge"
+  metricHistogram = "histogram"
+)
+
+type series struct {
+  values []string
+  value  float64
+  counts []uint64
+  sum    float64
+  count  uint64
+}
+
+// metric is a family of series in the Prometheus text format, one per
+// combination of label values
+type metric struct {
+  kind    string
+  name    string
+  help    string
+  labels  []string
+  buckets []float64
+
+  mu     sync.Mutex
+  series map[string]*series
+}
+
+func newMetric(kind, name, help string, labels ...string) *metric {
+  m := &metric{
+    kind:   kind,
+    name:   name,
+    help:   help,
+    labels: labels,
+    series: make(map[string]*series),
+  }
+
+  if kind == metricHistogram {
+    m.buckets = DefaultBuckets
+  }
+
+  return m
+}
+
+// get finds the series of values, called with mu held
+func (m *metric) get(values []string) *series {
+  key := strings.Join(values, "\xff")
+
+  s, ok := m.series[key]
+  if !ok {
+    s = &series{values: values}
+    if m.kind == metricHistogram {
+      s.counts = make([]uint64, len(m.buckets))
+    }
+    m.series[key] = s
+  }
+
+  return s
+}
+
+func (m *metric) add(v float64, values ...string) {
+  m.mu.Lock()
+  m.get(values).value += v
+  m.mu.Unlock()
+}
+
+func (m *metric) set(v float64, values ...string) {
+  m.mu.Lock()
+  m.get(values).value = v
+  m.mu.Unlock()
+}
+
+func (m *metric) observe(v float64, values ...string) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  s := m.get(values)
+  for i, le := range m.buckets {
+    if v <= le {
+      s.counts[i]++
+    }
+  }
+  s.sum += v
+  s.count++
+}
+
+func (m *metric) write(w io.Writer) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+  keys := make([]string, 0, len(m.series))
+  for k, _ := range m.series {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+
+  for _, k := range keys {
+    s := m.series[k]
+
+    if m.kind != metricHistogram {
+      fmt.Fprintf(w, "%s%s %s\n", m.name, labelSet(m.labels, s.values, "", ""), formatValue(s.value))
+      continue
+    }
+
+    for i, le := range m.buckets {
+      fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelSet(m.labels, s.values, "le", formatValue(le)), s.counts[i])
+    }
+    fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelSet(m.labels, s.values, "le", "+Inf"), s.count)
+    fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labelSet(m.labels, s.values, "", ""), formatValue(s.sum))
+    fmt.Fprintf(w, "%s_count%s %d\n", m.name, labelSet(m.labels, s.values, "", ""), s.count)
+  }
+}
+
+// labelSet renders {name="value",...}, with an extra label when given
+func labelSet(names, values []string, extra, extraValue string) string {
+  var pairs []string
+
+  for i, name := range names {
+    pairs = append(pairs, name+"="+quoteLabel(values[i]))
+  }
+
+  if extra != "" {
+    pairs = append(pairs, extra+"="+quoteLabel(extraValue))
+  }
+
+  if len(pairs) == 0 {
+    return ""
+  }
+
+  return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+  return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func formatValue(v float64) string {
+  return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+  metricRequests        = newMetric(metricCounter, "knuckles_requests_total", "Requests proxied, by status class.", "application", "backend", "code")
+  metricRequestDuration = newMetric(metricHistogram, "knuckles_request_duration_seconds", "Time to answer proxied requests.", "application", "backend")
+  metricTunnels         = newMetric(metricGauge, "knuckles_websocket_tunnels", "Websocket tunnels open.")
+  metricStoreDuration   = newMetric(metricHistogram, "knuckles_store_duration_seconds", "Store call latency.", "method")
+  metricStoreErrors     = newMetric(metricCounter, "knuckles_store_errors_total", "Store calls answering an error.", "method")
+  metricProbes          = newMetric(metricCounter, "knuckles_probes_total", "Health check probes, by result.", "application", "backend", "result")
+  metricProbeDuration   = newMetric(metricHistogram, "knuckles_probe_duration_seconds", "Health check probe latency.", "application")
+)
+
+// processMetrics are collected as things happen, every knuckles process
+// has its own
+var processMetrics = []*metric{
+  metricRequests,
+  metricRequestDuration,
+  metricTunnels,
+  metricStoreDuration,
+  metricStoreErrors,
+  metricProbes,
+  metricProbeDuration,
+}
+
+func observeRequest(e *AccessLogEntry) {
+  code := strconv.Itoa(e.Status/100) + "xx"
+
+  metricRequests.add(1, e.App, e.Backend, code)
+  metricRequestDuration.observe(e.Total, e.App, e.Backend)
+}
+
+func observeProbe(app, backend string, alive bool, took time.Duration) {
+  result := "alive"
+  if !alive {
+    result = "dead"
+  }
+
+  metricProbes.add(1, app, backend, result)
+  metricProbeDuration.observe(took.Seconds(), app)
+}
+
+// observeStoreCall is deferred by store calls, err is read once they return.
+// Errors the API answers with a status, like lookup misses, conflicts and
+// invalid input, are not errors of the store.
+func observeStoreCall(method string, started time.Time, err *error) {
+  metricStoreDuration.observe(time.Since(started).Seconds(), method)
+
+  if _, known := errorStatus[*err]; *err != nil && !known {
+    metricStoreErrors.add(1, method)
+  }
+}
@@ -0,0 +1,95 @@
+package knuckles
+
+import (
+  "bytes"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+func Test_MetricFormat(t *testing.T) {
+  m := newMetric(metricHistogram, "test_seconds", "Test latency.", "application")
+  m.observe(0.02, `a"b`)
+  m.observe(20, `a"b`)
+
+  var buf bytes.Buffer
+  m.write(&buf)
+
+  for _, line := range []string{
+    "# TYPE test_seconds histogram",
+    `test_seconds_bucket{application="a\"b",le="0.01"} 0`,
+    `test_seconds_bucket{application="a\"b",le="0.025"} 1`,
+    `test_seconds_bucket{application="a\"b",le="+Inf"} 2`,
+    `test_seconds_sum{application="a\"b"} 20.02`,
+    `test_seconds_count{application="a\"b"} 2`,
+  } {
+    if !strings.Contains(buf.String(), line+"\n") {
+      t.Fatal("Missing", line, "in", buf.String())
+    }
+  }
+}
+
+func Test_ServeMetrics(t *testing.T) {
+  s := NewMeteredStore(NewMemoryStore())
+  s.AddApplication("metricsapp")
+  s.AddApplication("metricsapp")
+  s.AddHostname("metricsapp", "metrics.com")
+  s.AddBackend("metricsapp", "10.0.0.1:8080", 0, 0)
+  s.AddBackend("metricsapp", "10.0.0.2:8080", 0, 0)
+  s.DisableBackend("metricsapp", "10.0.0.2:8080", "test")
+
+  proxy, err := NewHTTPProxy(HTTPProxyConfig{Store: s})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  r, _ := http.NewRequest("GET", "http://unknown-metrics.com/", nil)
+  proxy.ServeHTTP(httptest.NewRecorder(), r)
+
+  api, err := NewHTTPAPI(HTTPAPIConfig{Store: s})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  w := httptest.NewRecorder()
+  r, _ = http.NewRequest("GET", "/metrics", nil)
+  api.Server.Handler.ServeHTTP(w, r)
+
+  for _, line := range []string{
+    `knuckles_backends{application="metricsapp",state="live"} 1`,
+    `knuckles_backends{application="metricsapp",state="dead"} 1`,
+    `knuckles_requests_total{application="",backend="",code="4xx"}`,
+    `knuckles_store_duration_seconds_count{method="EndpointForHostname"}`,
+  } {
+    if !strings.Contains(w.Body.String(), line) {
+      t.Fatal("Missing", line, "in", w.Body.String())
+    }
+  }
+
+  // unknown hostnames and conflicts are answers, not store errors
+  for _, method := range []string{"EndpointForHostname", "AddApplication"} {
+    if strings.Contains(w.Body.String(), `knuckles_store_errors_total{method="`+method+`"}`) {
+      t.Fatal("Store answer counted as an error", method, w.Body.String())
+    }
+  }
+}
+
+func Test_ServeMetricsStoreDown(t *testing.T) {
+  api, err := NewHTTPAPI(HTTPAPIConfig{Store: NewMeteredStore(downStore{NewMemoryStore()})})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  w := httptest.NewRecorder()
+  r, _ := http.NewRequest("GET", "/metrics", nil)
+  api.Server.Handler.ServeHTTP(w, r)
+
+  if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "knuckles_backends{") {
+    t.Fatal("Unexpected metrics", w.Code, w.Body.String())
+  }
+
+  if !strings.Contains(w.Body.String(), `knuckles_store_errors_total{method="CountBackends"}`) {
+    t.Fatal("Process metrics missing", w.Body.String())
+  }
+}
@@ -0,0 +1,114 @@
+package knuckles
+
+import (
+  "fmt"
+  "log"
+  "sync"
+  "time"
+)
+
+const DefaultEjectCooldown = 30 * time.Second
+
+// Ejection records why passive checks took a backend out of rotation.
+// EnableBackend refuses the backend until the cooldown is over.
+type Ejection struct {
+  Reason string    `json:"reason"`
+  Until  time.Time `json:"until"`
+}
+
+func (e Ejection) Active() bool {
+  return time.Now().Before(e.Until)
+}
+
+type outlierKey struct {
+  app     string
+  backend string
+}
+
+// outlierDetector counts consecutive failures of proxied requests, in the
+// manner of Envoy's outlier detection. Backends reaching threshold are
+// ejected for cooldown.
+type outlierDetector struct {
+  mu        sync.Mutex
+  store     Store
+  threshold int
+  cooldown  time.Duration
+  failures  map[outlierKey]int
+}
+
+func newOutlierDetector(config HTTPProxyConfig) *outlierDetector {
+  o := &outlierDetector{
+    store:     config.Store,
+    threshold: config.EjectThreshold,
+    cooldown:  config.EjectCooldown,
+    failures:  make(map[outlierKey]int),
+  }
+
+  if o.cooldown <= 0 {
+    o.cooldown = DefaultEjectCooldown
+  }
+
+  return o
+}
+
+func (o *outlierDetector) success(app, backend string) {
+  if o.threshold <= 0 {
+    return
+  }
+
+  o.mu.Lock()
+  delete(o.failures, outlierKey{app, backend})
+  o.mu.Unlock()
+}
+
+func (o *outlierDetector) failure(app, backend, cause string) {
+  if o.threshold <= 0 {
+    return
+  }
+
+  key := outlierKey{app, backend}
+
+  o.mu.Lock()
+  o.failures[key]++
+  n := o.failures[key]
+  if n >= o.threshold {
+    delete(o.failures, key)
+  }
+  o.mu.Unlock()
+
+  if n >= o.threshold {
+    go o.eject(app, backend, fmt.Sprintf("%d consecutive failures, last: %s", n, cause))
+  }
+}
+
+func (o *outlierDetector) eject(app, backend, reason string) {
+  err := o.store.EjectBackend(app, backend, reason, o.cooldown)
+  if err != nil {
+    log.Println("Failed to eject", backend, "from", app+":", err)
+    return
+  }
+
+  log.Println("Ejected backend [", app, "]", backend, "for", o.cooldown, "after", reason)
+
+  time.AfterFunc(o.cooldown, func() {
+    o.restore(app, backend)
+  })
+}
+
+// restore puts a backend back once its cooldown is over, unless a pinger
+// checks it: the pinger enables it again after rise good probes, and keeps
+// it out if it found the backend dead in the meantime
+func (o *outlierDetector) restore(app, backend string) {
+  state, err := o.store.BackendHealth(app, backend)
+  if err == nil && (state.Successes > 0 || state.Failures > 0) {
+    return
+  }
+
+  if err == nil {
+    err = o.store.EnableBackend(app, backend, "ejection cooldown over")
+  }
+
+  if err != nil && err != ErrBackendEjected {
+    log.Println("Failed to restore", backend, "in", app+":", err)
+  }
+}
@@ -0,0 +1,72 @@
+package knuckles
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+func Test_OutlierCooldown(t *testing.T) {
+  s := NewMemoryStore()
+  s.AddApplication("testapp")
+  s.AddBackend("testapp", "10.0.0.1:8080", 0, 0)
+  s.AddBackend("testapp", "10.0.0.2:8080", 0, 0)
+
+  // the pinger found the second backend dead while it was ejected
+  s.SetBackendHealth("testapp", "10.0.0.2:8080", HealthState{Failures: 1})
+
+  o := newOutlierDetector(HTTPProxyConfig{Store: s, EjectThreshold: 1, EjectCooldown: 50 * time.Millisecond})
+  o.eject("testapp", "10.0.0.1:8080", "test")
+  o.eject("testapp", "10.0.0.2:8080", "test")
+
+  time.Sleep(200 * time.Millisecond)
+
+  _, backends, _ := s.DescribeApplication("testapp")
+  if !backends["10.0.0.1:8080"].Alive {
+    t.Fatal("Unchecked backend not restored")
+  }
+
+  if backends["10.0.0.2:8080"].Alive {
+    t.Fatal("Restored a backend the pinger found dead")
+  }
+}
+
+func Test_OutlierClientTimeout(t *testing.T) {
+  s := NewMemoryStore()
+  s.AddApplication("testapp")
+  s.AddHostname("testapp", "something.com")
+
+  for i := 0; i < 2; i++ {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      select {
+      case <-r.Context().Done():
+      case <-time.After(time.Second):
+      }
+    }))
+    defer srv.Close()
+    s.AddBackend("testapp", strings.TrimPrefix(srv.URL, "http://"), 0, 0)
+  }
+
+  h, err := NewHTTPProxy(HTTPProxyConfig{Store: s, Retries: 1, EjectThreshold: 1, EjectCooldown: time.Minute})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+  defer cancel()
+
+  r, _ := http.NewRequest("GET", "http://something.com/", nil)
+  h.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+
+  time.Sleep(100 * time.Millisecond)
+
+  _, backends, _ := s.DescribeApplication("testapp")
+  for addr, info := range backends {
+    if !info.Alive {
+      t.Fatal("Backend ejected after a client timeout", addr)
+    }
+  }
+}
@@ -3,149 +3,508 @@ package knuckles
 import (
   "fmt"
   "log"
-  "net"
-  "net/http"
+  "os"
+  "sort"
+  "sync"
+  "sync/atomic"
   "time"
 )
 
+const (
+  DefaultFlapWindow   = 5 * time.Minute
+  DefaultPingInterval = 5
+  DefaultPingWorkers  = 8
+  DefaultMaxProbes    = 32
+)
+
+// pingerGroup is where pingers sharing a store announce themselves
+const pingerGroup = "pingers"
+
 type PingWork struct {
   App      string
   Backends []string
+  Live     map[string]bool
+  Check    HealthCheck
+}
+
+// Rise and Fall are the consecutive probes needed to enable and disable
+// a backend. A backend changing state FlapThreshold times in FlapWindow
+// is held out of rotation for FlapHold, 0 disables flap detection.
+// Workers applications are checked at once, with at most MaxProbes
+// probes in flight over all of them.
+// Pingers sharing a Store announce themselves in it and split the
+// applications by rendezvous hashing over those alive. A pinger leaving
+// or missing its announcements for LeaseTTL (3 ping intervals by default)
+// hands its applications over. Each application is also leased by the
+// pinger checking it, so two pingers disagreeing on who is alive never
+// check it both; the lease expires LeaseTTL (3 check intervals by
+// default) after its last check.
+type PingerConfig struct {
+  Store         Store
+  Interval      int
+  Rise          int
+  Fall          int
+  FlapThreshold int
+  FlapWindow    time.Duration
+  FlapHold      time.Duration
+  Workers       int
+  MaxProbes     int
+  ID            string
+  LeaseTTL      time.Duration
+}
+
+type PingerStatus struct {
+  ID           string   `json:"id"`
+  Running      bool     `json:"running"`
+  Applications []string `json:"applications"`
 }
 
 type Pinger struct {
-  q           chan bool
-  Store       Store
-  interval    int
-  workingApps []string
+  q             chan bool
+  Store         Store
+  interval      int
+  rise          int
+  fall          int
+  flapThreshold int
+  flapWindow    time.Duration
+  flapHold      time.Duration
+  workers       int
+  probes        chan bool
+  id            string
+  leaseTTL      time.Duration
+
+  mu      sync.Mutex
+  started bool
+  next    map[string]time.Time
+  running map[string]bool
+  owned   map[string]time.Time
+
+  // what Status reports, mu is held across store calls
+  snapshot atomic.Value
 }
 
-func NewPinger(namespace, redis string, interval int) (*Pinger, error) {
-  var err error
+type pingerSnapshot struct {
+  started bool
+  owned   map[string]time.Time
+}
+
+func NewPinger(config PingerConfig) (*Pinger, error) {
   p := &Pinger{
-    q:        make(chan bool, 1),
-    interval: interval,
+    q:             make(chan bool, 1),
+    Store:         config.Store,
+    interval:      config.Interval,
+    rise:          config.Rise,
+    fall:          config.Fall,
+    flapThreshold: config.FlapThreshold,
+    flapWindow:    config.FlapWindow,
+    flapHold:      config.FlapHold,
+    workers:       config.Workers,
+    id:            config.ID,
+    leaseTTL:      config.LeaseTTL,
+    next:          make(map[string]time.Time),
+    running:       make(map[string]bool),
+    owned:         make(map[string]time.Time),
+  }
+
+  if p.id == "" {
+    host, _ := os.Hostname()
+    p.id = fmt.Sprintf("%s:%d", host, os.Getpid())
+  }
+
+  if p.interval <= 0 {
+    p.interval = DefaultPingInterval
+  }
+
+  if p.rise <= 0 {
+    p.rise = 1
+  }
+
+  if p.fall <= 0 {
+    p.fall = 1
+  }
+
+  if p.flapWindow <= 0 {
+    p.flapWindow = DefaultFlapWindow
+  }
+
+  if p.flapHold <= 0 {
+    p.flapHold = p.flapWindow
   }
 
-  p.Store, err = NewRedisStore(namespace, redis)
+  if p.workers <= 0 {
+    p.workers = DefaultPingWorkers
+  }
+
+  maxProbes := config.MaxProbes
+  if maxProbes <= 0 {
+    maxProbes = DefaultMaxProbes
+  }
+  p.probes = make(chan bool, maxProbes)
 
-  return p, err
+  return p, nil
 }
 
 func (pinger *Pinger) Start() error {
+  pinger.setStarted(true)
+  defer pinger.setStarted(false)
+
   ch := make(chan PingWork)
   go pinger.Feed(ch)
 
-  for {
-    w, ok := <-ch
-    if !ok {
-      break
-    }
+  var wg sync.WaitGroup
+
+  for i := 0; i < pinger.workers; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
 
-    pinger.Process(w)
+      for pw := range ch {
+        err := pinger.Process(pw)
+        if err != nil {
+          log.Println("Failed to check", pw.App+":", err)
+        }
+        pinger.finish(pw.App)
+      }
+    }()
   }
 
+  wg.Wait()
+
   return nil
 }
 
+// Feed hands out applications as their checks come due
 func (pinger *Pinger) Feed(ch chan PingWork) {
-  tick := time.NewTicker(time.Duration(pinger.interval) * time.Second)
+  tick := time.NewTicker(time.Second)
+  defer tick.Stop()
+
   for {
     select {
     case <-pinger.q:
       close(ch)
-      break
-    case <-tick.C:
-      pinger.feedOne(ch)
+      return
+    case now := <-tick.C:
+      for _, pw := range pinger.due(now) {
+        ch <- pw
+      }
     }
   }
-  tick.Stop()
 }
 
-func (pinger *Pinger) feedOne(ch chan PingWork) {
-  var err error
-  if len(pinger.workingApps) == 0 {
-    pinger.workingApps, err = pinger.Store.ListApplications()
+// due lists the applications to check now, each one is scheduled again
+// after its check interval. Applications hashed to another pinger, still
+// being checked or leased by another pinger are skipped.
+func (pinger *Pinger) due(now time.Time) []PingWork {
+  var work []PingWork
+
+  apps, err := pinger.Store.ListApplications()
+  if err != nil {
+    log.Println("Failed to get app list")
+    return work
+  }
+
+  members := pinger.members()
+
+  pinger.mu.Lock()
+  defer pinger.mu.Unlock()
+  defer pinger.publish()
+
+  known := make(map[string]bool)
+
+  for _, app := range apps {
+    known[app] = true
+
+    if rendezvous(app, members, nil) != pinger.id {
+      pinger.handOver(app)
+      continue
+    }
+
+    if pinger.running[app] || now.Before(pinger.next[app]) {
+      continue
+    }
+
+    check, err := pinger.Store.HealthCheckForApp(app)
     if err != nil {
-      log.Println("Failed to get app list")
-      return
+      log.Println("Failed to get health check for", app)
+      continue
+    }
+
+    interval := check.Interval
+    if interval <= 0 {
+      interval = time.Duration(pinger.interval) * time.Second
+    }
+    pinger.next[app] = now.Add(interval)
+
+    if !pinger.lease(app, interval, now) {
+      continue
+    }
+
+    pw, err := pinger.work(app, check)
+    if err != nil {
+      log.Println("Failed to get backend list for", app)
+      continue
     }
+
+    pinger.running[app] = true
+    work = append(work, pw)
   }
 
-  app := pinger.workingApps[0]
-  pinger.workingApps = pinger.workingApps[1:]
+  for app, _ := range pinger.next {
+    if !known[app] {
+      delete(pinger.next, app)
+      delete(pinger.owned, app)
+    }
+  }
 
-  _, belist, err := pinger.Store.DescribeApplication(app)
+  return work
+}
+
+// members announces this pinger and lists those alive, itself included
+// even when the store can't tell
+func (pinger *Pinger) members() []string {
+  ttl := pinger.leaseTTL
+  if ttl <= 0 {
+    ttl = 3 * time.Duration(pinger.interval) * time.Second
+  }
+
+  err := pinger.Store.JoinGroup(pingerGroup, pinger.id, ttl)
+  if err != nil {
+    log.Println("Failed to announce pinger", pinger.id+":", err)
+  }
 
+  members, err := pinger.Store.GroupMembers(pingerGroup)
   if err != nil {
-    log.Println("Failed to get backend list for", app)
+    log.Println("Failed to list pingers:", err)
+  }
+
+  for _, member := range members {
+    if member == pinger.id {
+      return members
+    }
+  }
+
+  return append(members, pinger.id)
+}
+
+// handOver releases the lease of an application hashed to another pinger,
+// so it can take it right away. Called with mu held.
+func (pinger *Pinger) handOver(app string) {
+  if _, owned := pinger.owned[app]; !owned {
     return
   }
 
-  log.Println("Starting checks on", app)
-  pw := PingWork{App: app}
-  for be, _ := range belist {
+  err := pinger.Store.ReleaseLease("pinger:"+app, pinger.id)
+  if err != nil {
+    log.Println("Failed to release lease of", app+":", err)
+  }
+
+  log.Println("Pinger", pinger.id, "hands", app, "over")
+  delete(pinger.owned, app)
+}
+
+// lease takes or renews the lease of app, called with mu held
+func (pinger *Pinger) lease(app string, interval time.Duration, now time.Time) bool {
+  ttl := pinger.leaseTTL
+  if ttl <= 0 {
+    ttl = 3 * interval
+  }
+
+  ok, err := pinger.Store.AcquireLease("pinger:"+app, pinger.id, ttl)
+  if err != nil {
+    log.Println("Failed to lease", app+":", err)
+  }
+
+  if ok {
+    if _, owned := pinger.owned[app]; !owned {
+      log.Println("Pinger", pinger.id, "now checks", app)
+    }
+    pinger.owned[app] = now.Add(ttl)
+  } else {
+    delete(pinger.owned, app)
+  }
+
+  return ok
+}
+
+// Status reports whether the pinger runs and the applications it holds
+// the lease of
+func (pinger *Pinger) Status() PingerStatus {
+  snap, _ := pinger.snapshot.Load().(pingerSnapshot)
+
+  status := PingerStatus{ID: pinger.id, Running: snap.started, Applications: []string{}}
+  now := time.Now()
+
+  for app, expires := range snap.owned {
+    if now.Before(expires) {
+      status.Applications = append(status.Applications, app)
+    }
+  }
+  sort.Strings(status.Applications)
+
+  return status
+}
+
+// publish copies what Status reports, called with mu held
+func (pinger *Pinger) publish() {
+  owned := make(map[string]time.Time, len(pinger.owned))
+  for app, expires := range pinger.owned {
+    owned[app] = expires
+  }
+
+  pinger.snapshot.Store(pingerSnapshot{started: pinger.started, owned: owned})
+}
+
+func (pinger *Pinger) setStarted(started bool) {
+  pinger.mu.Lock()
+  pinger.started = started
+  pinger.publish()
+  pinger.mu.Unlock()
+}
+
+func (pinger *Pinger) finish(app string) {
+  pinger.mu.Lock()
+  delete(pinger.running, app)
+  pinger.mu.Unlock()
+}
+
+func (pinger *Pinger) work(app string, check HealthCheck) (PingWork, error) {
+  pw := PingWork{App: app, Live: make(map[string]bool), Check: check}
+
+  _, belist, err := pinger.Store.DescribeApplication(app)
+  if err != nil {
+    return pw, err
+  }
+
+  for be, info := range belist {
     pw.Backends = append(pw.Backends, be)
+    pw.Live[be] = info.Alive
   }
 
-  ch <- pw
+  return pw, nil
 }
 
+// Process probes the backends of an application in parallel
 func (pinger *Pinger) Process(pw PingWork) error {
-  for _, backend := range pw.Backends {
-    alive := checkEndpoint(backend)
+  errs := make(chan error, len(pw.Backends))
 
-    status := "alive"
-    if !alive {
-      status = "dead"
-    }
+  for _, backend := range pw.Backends {
+    go func(backend string) {
+      pinger.probes <- true
+      defer func() { <-pinger.probes }()
 
-    log.Println("Backend [", pw.App, "]", backend, "is", status)
+      started := time.Now()
+      expires, err := checkEndpoint(backend, pw.Check)
+      observeProbe(pw.App, backend, err == nil, time.Since(started))
 
-    if alive {
-      err := pinger.Store.EnableBackend(pw.App, backend)
-      if err != nil {
-        return err
-      }
-    } else {
-      err := pinger.Store.DisableBackend(pw.App, backend)
-      if err != nil {
-        return err
+      if err == nil {
+        log.Println("Backend [", pw.App, "]", backend, "is alive")
+      } else {
+        log.Println("Backend [", pw.App, "]", backend, "is dead:", err)
       }
+
+      errs <- pinger.judge(pw.App, backend, pw.Live[backend], err, expires)
+    }(backend)
+  }
+
+  var err error
+  for _ = range pw.Backends {
+    if e := <-errs; e != nil && err == nil {
+      err = e
     }
   }
 
-  return nil
+  return err
 }
 
-func (pinger *Pinger) Stop() error {
-  pinger.q <- true
-  return nil
-}
+// judge changes the liveness of backend once rise or fall consecutive
+// probes agree, holding it out while it flaps. probeErr is the result of
+// the last probe.
+func (pinger *Pinger) judge(app, backend string, live bool, probeErr error, certExpires time.Time) error {
+  state, err := pinger.Store.BackendHealth(app, backend)
+  if err != nil {
+    return err
+  }
 
-// We don't care if it returns 2xx,3xx,4xx,5xx
-// as long as it is alive
-func checkEndpoint(endpoint string) bool {
-  tr := &http.Transport{
-    Dial: dialTimeout,
+  alive := probeErr == nil
+  state.observe(alive)
+  if alive {
+    state.CertExpires = certExpires
   }
 
-  req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s", endpoint), nil)
-  req.Close = true
+  want := live
+  var reason string
+
+  if !live && state.Successes >= pinger.rise {
+    want = true
+    reason = fmt.Sprintf("%d consecutive checks passed", state.Successes)
+  }
+  if live && state.Failures >= pinger.fall {
+    want = false
+    reason = fmt.Sprintf("%d consecutive checks failed: %v", state.Failures, probeErr)
+  }
+
+  now := time.Now()
+  if want != live && !state.Flapping() && pinger.flapThreshold > 0 {
+    state.prune(now, pinger.flapWindow)
+
+    if len(state.Transitions)+1 >= pinger.flapThreshold {
+      log.Println("Backend [", app, "]", backend, "is flapping, holding it out for", pinger.flapHold)
+      reason = fmt.Sprintf("flapping, %d changes within %s", len(state.Transitions)+1, pinger.flapWindow)
+      state.FlappingUntil = now.Add(pinger.flapHold)
+      state.Transitions = nil
+    }
+  }
 
-  resp, err := tr.RoundTrip(req)
-  if err == nil {
-    defer resp.Body.Close()
+  if state.Flapping() {
+    want = false
+  }
+
+  // only changes that reached the store count towards flapping
+  changed := false
+  if want && !live {
+    err = pinger.Store.EnableBackend(app, backend, reason)
+    if err == ErrBackendEjected {
+      log.Println("Backend [", app, "]", backend, "is ejected, leaving it out")
+      err = nil
+    } else {
+      changed = err == nil
+    }
+  } else if !want && live {
+    err = pinger.Store.DisableBackend(app, backend, reason)
+    changed = err == nil
   }
 
   if err != nil {
-    return false
+    return err
   }
 
-  return true
+  if changed && !state.Flapping() {
+    state.transition(now, pinger.flapWindow)
+  }
+
+  return pinger.Store.SetBackendHealth(app, backend, state)
 }
 
-func dialTimeout(network, addr string) (net.Conn, error) {
-  timeout := time.Duration(2 * time.Second)
-  return net.DialTimeout(network, addr, timeout)
+// Stop hands the leases over to the other pingers right away
+func (pinger *Pinger) Stop() error {
+  pinger.q <- true
+
+  err := pinger.Store.LeaveGroup(pingerGroup, pinger.id)
+  if err != nil {
+    log.Println("Failed to leave pingers:", err)
+  }
+
+  pinger.mu.Lock()
+  defer pinger.mu.Unlock()
+
+  for app, _ := range pinger.owned {
+    err := pinger.Store.ReleaseLease("pinger:"+app, pinger.id)
+    if err != nil {
+      log.Println("Failed to release lease of", app+":", err)
+    }
+  }
+  pinger.owned = make(map[string]time.Time)
+  pinger.publish()
+
+  return nil
 }
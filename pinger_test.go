@@ -0,0 +1,204 @@
+package knuckles
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+func Test_PingerProcess(t *testing.T) {
+  var backends []string
+
+  for _, status := range []int{200, 503, 200} {
+    code := status
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      w.WriteHeader(code)
+    }))
+    defer srv.Close()
+    backends = append(backends, strings.TrimPrefix(srv.URL, "http://"))
+  }
+
+  s := NewMemoryStore()
+  s.AddApplication("testapp")
+  for _, be := range backends {
+    s.AddBackend("testapp", be, 0, 0)
+  }
+  s.SetHealthCheck("testapp", HealthCheck{Path: "/", Method: "GET", Status: "200-299", Timeout: time.Second})
+
+  p, _ := NewPinger(PingerConfig{Store: s, MaxProbes: 1})
+
+  work := p.due(time.Now())
+  if len(work) != 1 || len(work[0].Backends) != 3 || work[0].Check.Status != "200-299" {
+    t.Fatal("Unexpected work", work)
+  }
+
+  if len(p.due(time.Now())) != 0 {
+    t.Fatal("Application scheduled while being checked")
+  }
+
+  err := p.Process(work[0])
+  if err != nil {
+    t.Fatal(err)
+  }
+  p.finish("testapp")
+
+  _, info, _ := s.DescribeApplication("testapp")
+  if !info[backends[0]].Alive || info[backends[1]].Alive || !info[backends[2]].Alive {
+    t.Fatal("Unexpected liveness", info)
+  }
+
+  if len(p.due(time.Now())) != 0 {
+    t.Fatal("Application scheduled before its interval")
+  }
+
+  if len(p.due(time.Now().Add(time.Duration(DefaultPingInterval)*time.Second))) != 1 {
+    t.Fatal("Application not scheduled after its interval")
+  }
+}
+
+func Test_PingerLeases(t *testing.T) {
+  s := NewMemoryStore()
+  for i := 0; i < 20; i++ {
+    s.AddApplication(fmt.Sprintf("app%d", i))
+  }
+
+  p1, _ := NewPinger(PingerConfig{Store: s, ID: "p1"})
+  p2, _ := NewPinger(PingerConfig{Store: s, ID: "p2"})
+
+  // a pass where each pinger checks what it got
+  pass := func(at time.Time, pingers ...*Pinger) {
+    for _, p := range pingers {
+      for _, pw := range p.due(at) {
+        p.finish(pw.App)
+      }
+    }
+  }
+
+  // p1 starts alone and takes everything, p2 joining gets its share once
+  // p1 saw it and handed the leases over
+  now := time.Now()
+  interval := time.Duration(DefaultPingInterval) * time.Second
+  for i := 0; i < 3; i++ {
+    pass(now.Add(time.Duration(i)*interval), p1, p2)
+  }
+
+  first, second := p1.Status().Applications, p2.Status().Applications
+  if len(first) == 0 || len(second) == 0 || len(first)+len(second) != 20 {
+    t.Fatal("Applications not split", first, second)
+  }
+
+  for _, app := range first {
+    for _, other := range second {
+      if app == other {
+        t.Fatal("Application checked twice", app)
+      }
+    }
+  }
+
+  p1.Stop()
+
+  later := now.Add(3 * interval)
+  if len(p2.due(later)) != 20 {
+    t.Fatal("Leases not handed over")
+  }
+
+  status := p2.Status()
+  if status.ID != "p2" || len(status.Applications) != 20 {
+    t.Fatal("Unexpected shard", status)
+  }
+}
+
+// Test_PingerStatusUnblocked checks Status answers while a pass waits on
+// the store with the lock held
+func Test_PingerStatusUnblocked(t *testing.T) {
+  s := NewMemoryStore()
+  s.AddApplication("testapp")
+
+  p, _ := NewPinger(PingerConfig{Store: s, ID: "p1"})
+  p.due(time.Now())
+
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  done := make(chan PingerStatus, 1)
+  go func() {
+    done <- p.Status()
+  }()
+
+  select {
+  case status := <-done:
+    if len(status.Applications) != 1 {
+      t.Fatal("Unexpected status", status)
+    }
+  case <-time.After(time.Second):
+    t.Fatal("Status blocked on the pinger lock")
+  }
+}
+
+func Test_PingerCheckTypes(t *testing.T) {
+  plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  defer plain.Close()
+  secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  defer secure.Close()
+
+  plainAddr := strings.TrimPrefix(plain.URL, "http://")
+  secureAddr := strings.TrimPrefix(secure.URL, "https://")
+  notAfter := secure.TLS.Certificates[0].Leaf
+
+  check := DefaultHealthCheck()
+
+  for _, kind := range []string{CheckTCP, CheckHTTP} {
+    check.Type = kind
+    if _, err := checkEndpoint(plainAddr, check); err != nil {
+      t.Fatal(kind, "check failed", err)
+    }
+  }
+
+  for _, kind := range []string{CheckTLS, CheckHTTPS} {
+    check.Type = kind
+    expires, err := checkEndpoint(secureAddr, check)
+    if err != nil {
+      t.Fatal(kind, "check failed", err)
+    }
+    if expires.IsZero() || (notAfter != nil && !expires.Equal(notAfter.NotAfter)) {
+      t.Fatal(kind, "check did not record the certificate expiry", expires)
+    }
+
+    check.Verify = true
+    if _, err := checkEndpoint(secureAddr, check); err == nil {
+      t.Fatal(kind, "check accepted an untrusted certificate")
+    }
+    check.Verify = false
+  }
+
+  check.Type = CheckTLS
+  if _, err := checkEndpoint(plainAddr, check); err == nil {
+    t.Fatal("TLS check passed on a plain backend")
+  }
+}
+
+// Test_PingerEjectedNotFlapping checks probes refused by an ejection don't
+// count as liveness changes
+func Test_PingerEjectedNotFlapping(t *testing.T) {
+  s := NewMemoryStore()
+  s.AddApplication("testapp")
+  s.AddBackend("testapp", "10.0.0.1:8080", 0, 0)
+  s.EjectBackend("testapp", "10.0.0.1:8080", "outlier", time.Minute)
+
+  p, _ := NewPinger(PingerConfig{Store: s, Rise: 2, FlapThreshold: 4, FlapWindow: time.Minute})
+
+  for i := 0; i < 6; i++ {
+    err := p.judge("testapp", "10.0.0.1:8080", false, nil, time.Time{})
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  state, _ := s.BackendHealth("testapp", "10.0.0.1:8080")
+  if state.Flapping() || len(state.Transitions) != 0 {
+    t.Fatal("Ejected backend marked flapping", state)
+  }
+}
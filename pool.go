@@ -0,0 +1,91 @@
+package knuckles
+
+import (
+  "net/http"
+  "sync"
+  "time"
+)
+
+const (
+  DefaultMaxIdleConnsPerHost = 32
+  DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// backendPool keeps one keep-alive transport per backend of each
+// application, so the connections of a backend removed from one
+// application can be closed without touching the others sharing it.
+type backendPool struct {
+  mu                  sync.Mutex
+  transports          map[poolKey]*http.Transport
+  maxIdleConnsPerHost int
+  maxConnsPerHost     int
+  idleConnTimeout     time.Duration
+}
+
+type poolKey struct {
+  app     string
+  backend string
+}
+
+func newBackendPool(config HTTPProxyConfig) *backendPool {
+  p := &backendPool{
+    transports:          make(map[poolKey]*http.Transport),
+    maxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+    maxConnsPerHost:     config.MaxConnsPerHost,
+    idleConnTimeout:     config.IdleConnTimeout,
+  }
+
+  if p.maxIdleConnsPerHost <= 0 {
+    p.maxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+  }
+
+  if p.idleConnTimeout <= 0 {
+    p.idleConnTimeout = DefaultIdleConnTimeout
+  }
+
+  return p
+}
+
+func (p *backendPool) transport(app, backend string) *http.Transport {
+  key := poolKey{app, backend}
+
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  tr, ok := p.transports[key]
+  if !ok {
+    tr = &http.Transport{
+      MaxIdleConnsPerHost: p.maxIdleConnsPerHost,
+      MaxConnsPerHost:     p.maxConnsPerHost,
+      IdleConnTimeout:     p.idleConnTimeout,
+    }
+    p.transports[key] = tr
+  }
+
+  return tr
+}
+
+// close drops the pool of backend in app, in-flight requests finish normally
+func (p *backendPool) close(app, backend string) {
+  key := poolKey{app, backend}
+
+  p.mu.Lock()
+  tr, ok := p.transports[key]
+  delete(p.transports, key)
+  p.mu.Unlock()
+
+  if ok {
+    tr.CloseIdleConnections()
+  }
+}
+
+func (p *backendPool) closeAll() {
+  p.mu.Lock()
+  transports := p.transports
+  p.transports = make(map[poolKey]*http.Transport)
+  p.mu.Unlock()
+
+  for _, tr := range transports {
+    tr.CloseIdleConnections()
+  }
+}
@@ -0,0 +1,82 @@
+package knuckles
+
+import (
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+func Test_BackendPool(t *testing.T) {
+  var opened, closed int32
+
+  srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+  srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+    switch state {
+    case http.StateNew:
+      atomic.AddInt32(&opened, 1)
+    case http.StateClosed:
+      atomic.AddInt32(&closed, 1)
+    }
+  }
+  srv.Start()
+  defer srv.Close()
+  backend := strings.TrimPrefix(srv.URL, "http://")
+
+  // both applications share the backend
+  s := NewMemoryStore()
+  for _, app := range []string{"app1", "app2"} {
+    s.AddApplication(app)
+    s.AddHostname(app, app+".com")
+    s.AddBackend(app, backend, 0, 0)
+  }
+
+  h, err := NewHTTPProxy(HTTPProxyConfig{Store: s, Addr: "127.0.0.1:0"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  go h.Start()
+  defer h.Stop()
+
+  for !h.Bound() {
+    time.Sleep(10 * time.Millisecond)
+  }
+
+  for i := 0; i < 3; i++ {
+    w := httptest.NewRecorder()
+    r, _ := http.NewRequest("GET", "http://app1.com/", nil)
+    h.ServeHTTP(w, r)
+
+    if w.Code != http.StatusOK {
+      t.Fatal("Unexpected status", w.Code)
+    }
+  }
+
+  if n := atomic.LoadInt32(&opened); n != 1 {
+    t.Fatal("Connections not reused", n)
+  }
+
+  pooled := func(app string) bool {
+    h.pool.mu.Lock()
+    defer h.pool.mu.Unlock()
+    _, ok := h.pool.transports[poolKey{app, backend}]
+    return ok
+  }
+
+  s.RemoveBackend("app2", backend)
+  time.Sleep(100 * time.Millisecond)
+
+  if !pooled("app1") || atomic.LoadInt32(&closed) != 0 {
+    t.Fatal("Pool closed for an application still using the backend")
+  }
+
+  s.RemoveBackend("app1", backend)
+  time.Sleep(100 * time.Millisecond)
+
+  if n := atomic.LoadInt32(&closed); pooled("app1") || n != 1 {
+    t.Fatal("Pool kept after the backend was removed", n)
+  }
+}
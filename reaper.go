@@ -0,0 +1,94 @@
+package knuckles
+
+import (
+  "log"
+  "sync/atomic"
+  "time"
+)
+
+const DefaultReapInterval = 10 * time.Second
+
+// expired tells whether a backend ttl, a unix time, has run out
+func expired(ttl int, now time.Time) bool {
+  return ttl > 0 && int(now.Unix()) > ttl
+}
+
+// unexpired drops the backends whose ttl ran out
+func unexpired(backends []string, ttls map[string]int, now time.Time) []string {
+  if len(ttls) == 0 {
+    return backends
+  }
+
+  var kept []string
+  for _, be := range backends {
+    if !expired(ttls[be], now) {
+      kept = append(kept, be)
+    }
+  }
+
+  return kept
+}
+
+type ReaperConfig struct {
+  Store    Store
+  Interval time.Duration
+}
+
+// Reaper removes backends that missed their heartbeats, so they don't
+// linger until something happens to look at them
+type Reaper struct {
+  reaped   uint64
+  q        chan bool
+  Store    Store
+  interval time.Duration
+}
+
+func NewReaper(config ReaperConfig) (*Reaper, error) {
+  r := &Reaper{
+    q:        make(chan bool, 1),
+    Store:    config.Store,
+    interval: config.Interval,
+  }
+
+  if r.interval <= 0 {
+    r.interval = DefaultReapInterval
+  }
+
+  return r, nil
+}
+
+func (r *Reaper) Start() error {
+  tick := time.NewTicker(r.interval)
+  defer tick.Stop()
+
+  for {
+    select {
+    case <-r.q:
+      return nil
+    case <-tick.C:
+      r.Reap()
+    }
+  }
+}
+
+func (r *Reaper) Reap() {
+  n, err := r.Store.ReapBackends()
+  if err != nil {
+    log.Println("Failed to reap backends:", err)
+  }
+
+  if n > 0 {
+    log.Println("Reaped", n, "expired backends")
+    atomic.AddUint64(&r.reaped, uint64(n))
+  }
+}
+
+// Reaped counts the backends removed by this reaper
+func (r *Reaper) Reaped() uint64 {
+  return atomic.LoadUint64(&r.reaped)
+}
+
+func (r *Reaper) Stop() error {
+  r.q <- true
+  return nil
+}
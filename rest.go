@@ -0,0 +1,343 @@
+package knuckles
+
+import (
+  "encoding/json"
+  "io"
+  "net/http"
+  "strings"
+)
+
+// maxRequestBody bounds the JSON bodies read by the REST API
+const maxRequestBody = 1 << 20
+
+// errorStatus maps store errors to the status codes of the REST API,
+// anything else is a 500
+var errorStatus = map[error]int{
+  ErrNoApp:         http.StatusNotFound,
+  ErrNoBackend:     http.StatusNotFound,
+  ErrNoHostname:    http.StatusNotFound,
+  ErrNoRoute:       http.StatusNotFound,
+  ErrNoCertificate: http.StatusNotFound,
+  ErrNoErrorPage:   http.StatusNotFound,
+  ErrNoResource:    http.StatusNotFound,
+
+  ErrAppAlreadyExists:      http.StatusConflict,
+  ErrBackendAlreadyExists:  http.StatusConflict,
+  ErrHostnameAlreadyExists: http.StatusConflict,
+  ErrFrontendAlreadyExists: http.StatusConflict,
+  ErrRouteAlreadyExists:    http.StatusConflict,
+  ErrBackendEjected:        http.StatusConflict,
+  ErrNoTTL:                 http.StatusConflict,
+
+  ErrInvalidAction:      http.StatusBadRequest,
+  ErrInvalidStrategy:    http.StatusBadRequest,
+  ErrInvalidWeight:      http.StatusBadRequest,
+  ErrInvalidHostname:    http.StatusBadRequest,
+  ErrInvalidPrefix:      http.StatusBadRequest,
+  ErrInvalidCertificate: http.StatusBadRequest,
+  ErrInvalidHealthCheck: http.StatusBadRequest,
+  ErrInvalidErrorPage:   http.StatusBadRequest,
+  ErrInvalidBody:        http.StatusBadRequest,
+
+  ErrMethodNotAllowed: http.StatusMethodNotAllowed,
+}
+
+type ErrorResponse struct {
+  Error  string `json:"error"`
+  Status int    `json:"status"`
+}
+
+// AppRequest is the optional body of PUT and PATCH /v1/apps/{app}
+type AppRequest struct {
+  Strategy *Strategy `json:"strategy,omitempty"`
+  Affinity *bool     `json:"affinity,omitempty"`
+}
+
+// BackendRequest is the body of PUT /v1/apps/{app}/backends/{backend},
+// and of its heartbeats where only TTL is read
+type BackendRequest struct {
+  TTL    int `json:"ttl"`
+  Weight int `json:"weight"`
+}
+
+type HostnameResponse struct {
+  Application string `json:"application"`
+  Hostname    string `json:"hostname"`
+}
+
+type HostnamesResponse struct {
+  Hostnames []string `json:"hostnames"`
+}
+
+type BackendsResponse struct {
+  Backends map[string]BackendInfo `json:"backends"`
+}
+
+// ServeV1 routes the REST API:
+//
+//   /v1/apps
+//   /v1/apps/{app}
+//   /v1/apps/{app}/hostnames[/{hostname}]
+//   /v1/apps/{app}/backends[/{backend}[/heartbeat]]
+func (h *HTTPAPI) ServeV1(w http.ResponseWriter, r *http.Request) {
+  parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/"), "/"), "/")
+
+  if parts[0] != "apps" {
+    writeError(w, ErrNoResource)
+    return
+  }
+
+  switch {
+  case len(parts) == 1:
+    h.v1Apps(w, r)
+  case len(parts) == 2:
+    h.v1App(w, r, parts[1])
+  case len(parts) == 3 && parts[2] == "hostnames":
+    h.v1Hostnames(w, r, parts[1])
+  case len(parts) == 4 && parts[2] == "hostnames":
+    h.v1Hostname(w, r, parts[1], parts[3])
+  case len(parts) == 3 && parts[2] == "backends":
+    h.v1Backends(w, r, parts[1])
+  case len(parts) == 4 && parts[2] == "backends":
+    h.v1Backend(w, r, parts[1], parts[3])
+  case len(parts) == 5 && parts[2] == "backends" && parts[4] == "heartbeat":
+    h.v1Heartbeat(w, r, parts[1], parts[3])
+  default:
+    writeError(w, ErrNoResource)
+  }
+}
+
+func (h *HTTPAPI) v1Apps(w http.ResponseWriter, r *http.Request) {
+  if r.Method != "GET" {
+    notAllowed(w, "GET")
+    return
+  }
+
+  apps, err := h.Db.ListApplications()
+  if err != nil {
+    writeError(w, err)
+    return
+  }
+
+  if apps == nil {
+    apps = []string{}
+  }
+
+  writeJSON(w, http.StatusOK, &ListResponse{Applications: apps})
+}
+
+func (h *HTTPAPI) v1App(w http.ResponseWriter, r *http.Request, app string) {
+  var req AppRequest
+
+  switch r.Method {
+  case "GET":
+    ir, err := h.describe(app)
+    if err != nil {
+      writeError(w, err)
+      return
+    }
+    writeJSON(w, http.StatusOK, &ir)
+
+  case "PUT":
+    err := decodeBody(r, &req)
+    if err == nil && req.Strategy != nil {
+      err = req.Strategy.Validate()
+    }
+    if err == nil {
+      err = h.Db.AddApplication(app)
+    }
+    if err == nil {
+      err = h.applySettings(app, req)
+    }
+    writeResult(w, err)
+
+  case "PATCH":
+    err := decodeBody(r, &req)
+    if err == nil {
+      _, _, err = h.Db.DescribeApplication(app)
+    }
+    if err == nil {
+      err = h.applySettings(app, req)
+    }
+    writeResult(w, err)
+
+  case "DELETE":
+    writeResult(w, h.Db.RemoveApplication(app))
+
+  default:
+    notAllowed(w, "GET, PUT, PATCH, DELETE")
+  }
+}
+
+// applySettings sets what the request carries, leaving the rest alone
+func (h *HTTPAPI) applySettings(app string, req AppRequest) error {
+  if req.Strategy != nil {
+    err := h.Db.SetStrategy(app, *req.Strategy)
+    if err != nil {
+      return err
+    }
+  }
+
+  if req.Affinity != nil {
+    return h.Db.SetAffinity(app, *req.Affinity)
+  }
+
+  return nil
+}
+
+func (h *HTTPAPI) v1Hostnames(w http.ResponseWriter, r *http.Request, app string) {
+  if r.Method != "GET" {
+    notAllowed(w, "GET")
+    return
+  }
+
+  hostnames, _, err := h.Db.DescribeApplication(app)
+  if err != nil {
+    writeError(w, err)
+    return
+  }
+
+  if hostnames == nil {
+    hostnames = []string{}
+  }
+
+  writeJSON(w, http.StatusOK, &HostnamesResponse{Hostnames: hostnames})
+}
+
+func (h *HTTPAPI) v1Hostname(w http.ResponseWriter, r *http.Request, app, hostname string) {
+  switch r.Method {
+  case "GET":
+    hostnames, _, err := h.Db.DescribeApplication(app)
+    if err != nil {
+      writeError(w, err)
+      return
+    }
+
+    for _, name := range hostnames {
+      if name == hostname {
+        writeJSON(w, http.StatusOK, &HostnameResponse{Application: app, Hostname: hostname})
+        return
+      }
+    }
+    writeError(w, ErrNoHostname)
+
+  case "PUT":
+    writeResult(w, h.Db.AddHostname(app, hostname))
+
+  case "DELETE":
+    writeResult(w, h.Db.RemoveHostname(app, hostname))
+
+  default:
+    notAllowed(w, "GET, PUT, DELETE")
+  }
+}
+
+func (h *HTTPAPI) v1Backends(w http.ResponseWriter, r *http.Request, app string) {
+  if r.Method != "GET" {
+    notAllowed(w, "GET")
+    return
+  }
+
+  _, backends, err := h.Db.DescribeApplication(app)
+  if err != nil {
+    writeError(w, err)
+    return
+  }
+
+  writeJSON(w, http.StatusOK, &BackendsResponse{Backends: backends})
+}
+
+func (h *HTTPAPI) v1Backend(w http.ResponseWriter, r *http.Request, app, backend string) {
+  switch r.Method {
+  case "GET":
+    _, backends, err := h.Db.DescribeApplication(app)
+    if err != nil {
+      writeError(w, err)
+      return
+    }
+
+    info, ok := backends[backend]
+    if !ok {
+      writeError(w, ErrNoBackend)
+      return
+    }
+    writeJSON(w, http.StatusOK, &info)
+
+  case "PUT":
+    var req BackendRequest
+
+    err := decodeBody(r, &req)
+    if err == nil {
+      err = h.Db.AddBackend(app, backend, req.TTL, req.Weight)
+    }
+    writeResult(w, err)
+
+  case "DELETE":
+    writeResult(w, h.Db.RemoveBackend(app, backend))
+
+  default:
+    notAllowed(w, "GET, PUT, DELETE")
+  }
+}
+
+// v1Heartbeat renews a backend ttl, by the registered one unless the
+// body carries another
+func (h *HTTPAPI) v1Heartbeat(w http.ResponseWriter, r *http.Request, app, backend string) {
+  if r.Method != "POST" {
+    notAllowed(w, "POST")
+    return
+  }
+
+  var req BackendRequest
+
+  err := decodeBody(r, &req)
+  if err == nil {
+    err = h.Db.RenewBackend(app, backend, req.TTL)
+  }
+  writeResult(w, err)
+}
+
+// decodeBody reads a JSON body into v, an empty body leaves v alone
+func decodeBody(r *http.Request, v interface{}) error {
+  err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBody)).Decode(v)
+  if err == io.EOF {
+    return nil
+  }
+
+  if err != nil {
+    return ErrInvalidBody
+  }
+
+  return nil
+}
+
+// writeResult answers mutations, 204 when they succeeded
+func writeResult(w http.ResponseWriter, err error) {
+  if err != nil {
+    writeError(w, err)
+    return
+  }
+
+  w.WriteHeader(http.StatusNoContent)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+  status, ok := errorStatus[err]
+  if !ok {
+    status = http.StatusInternalServerError
+  }
+
+  writeJSON(w, status, &ErrorResponse{Error: err.Error(), Status: status})
+}
+
+func notAllowed(w http.ResponseWriter, methods string) {
+  w.Header().Set("Allow", methods)
+  writeError(w, ErrMethodNotAllowed)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+
+  json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,89 @@
+package knuckles
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "testing"
+)
+
+func Test_RestAPI(t *testing.T) {
+  s := NewMemoryStore()
+  api, _ := NewHTTPAPI(HTTPAPIConfig{Store: s})
+
+  call := func(method, path, body string, code int) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    r, _ := http.NewRequest(method, path, strings.NewReader(body))
+    api.Server.Handler.ServeHTTP(w, r)
+
+    if w.Code != code {
+      t.Fatal(method, path, "answered", w.Code, "instead of", code, w.Body.String())
+    }
+
+    return w
+  }
+
+  call("PUT", "/v1/apps/restapp", `{"strategy":{"name":"round-robin"},"affinity":true}`, http.StatusNoContent)
+  call("PUT", "/v1/apps/restapp/hostnames/rest.com", "", http.StatusNoContent)
+  call("PUT", "/v1/apps/restapp/backends/10.0.0.1:8080", `{"ttl":30,"weight":3}`, http.StatusNoContent)
+  call("POST", "/v1/apps/restapp/backends/10.0.0.1:8080/heartbeat", "", http.StatusNoContent)
+
+  var ir InfoResponse
+  w := call("GET", "/v1/apps/restapp", "", http.StatusOK)
+  json.Unmarshal(w.Body.Bytes(), &ir)
+
+  if ir.Strategy.Name != "round-robin" || !ir.Affinity || len(ir.Hostnames) != 1 || ir.Backends["10.0.0.1:8080"].Weight != 3 {
+    t.Fatal("Unexpected application", w.Body.String())
+  }
+
+  call("PATCH", "/v1/apps/restapp", `{"affinity":false}`, http.StatusNoContent)
+  affinity, _ := s.AffinityForApp("restapp")
+  if affinity {
+    t.Fatal("Affinity not patched")
+  }
+
+  call("GET", "/v1/apps/restapp/hostnames/rest.com", "", http.StatusOK)
+  call("GET", "/v1/apps/restapp/backends/10.0.0.1:8080", "", http.StatusOK)
+
+  var er ErrorResponse
+  w = call("GET", "/v1/apps/nothing", "", http.StatusNotFound)
+  json.Unmarshal(w.Body.Bytes(), &er)
+  if er.Error != ErrNoApp.Error() || er.Status != http.StatusNotFound {
+    t.Fatal("Unexpected error body", w.Body.String())
+  }
+
+  call("PUT", "/v1/apps/restapp", "", http.StatusConflict)
+  call("PUT", "/v1/apps/other", `{"strategy":{"name":"nope"}}`, http.StatusBadRequest)
+  call("PUT", "/v1/apps/other", `{`, http.StatusBadRequest)
+  call("GET", "/v1/apps/other", "", http.StatusNotFound)
+  call("GET", "/v1/apps/restapp/backends/10.0.0.2:8080", "", http.StatusNotFound)
+  call("GET", "/v1/apps/restapp/nothing", "", http.StatusNotFound)
+
+  w = call("POST", "/v1/apps/restapp", "", http.StatusMethodNotAllowed)
+  if w.Header().Get("Allow") == "" {
+    t.Fatal("Missing Allow header")
+  }
+
+  // the form API keeps its plain-text errors
+  w = httptest.NewRecorder()
+  r, _ := http.NewRequest("POST", "/api", strings.NewReader(url.Values{"action": {"add-application"}, "application": {"restapp"}}.Encode()))
+  r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  api.Server.Handler.ServeHTTP(w, r)
+  if w.Code != http.StatusInternalServerError || strings.TrimSpace(w.Body.String()) != ErrAppAlreadyExists.Error() {
+    t.Fatal("Legacy API changed", w.Code, w.Body.String())
+  }
+
+  call("DELETE", "/v1/apps/restapp/backends/10.0.0.1:8080", "", http.StatusNoContent)
+  call("DELETE", "/v1/apps/restapp/hostnames/rest.com", "", http.StatusNoContent)
+  call("DELETE", "/v1/apps/restapp/backends/10.0.0.1:8080", "", http.StatusNotFound)
+  call("DELETE", "/v1/apps/restapp/hostnames/rest.com", "", http.StatusNotFound)
+  call("DELETE", "/v1/apps/restapp", "", http.StatusNoContent)
+  call("GET", "/v1/apps/restapp/hostnames", "", http.StatusNotFound)
+
+  w = call("GET", "/v1/apps", "", http.StatusOK)
+  if strings.TrimSpace(w.Body.String()) != `{"applications":[]}` {
+    t.Fatal("Unexpected list", w.Body.String())
+  }
+}
@@ -0,0 +1,61 @@
+package knuckles
+
+import (
+  "bytes"
+  "io"
+  "io/ioutil"
+  "net"
+  "net/http"
+)
+
+// maxRetryBody is the largest request body kept in memory to be sent again
+// to another backend
+const maxRetryBody = 64 << 10
+
+// bufferBody reads small request bodies so every attempt sends its own copy.
+// Larger and chunked bodies are streamed once and never retried.
+func bufferBody(r *http.Request) (body []byte, resendable bool, err error) {
+  if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+    return nil, true, nil
+  }
+
+  if r.ContentLength < 0 || r.ContentLength > maxRetryBody {
+    return nil, false, nil
+  }
+
+  body, err = ioutil.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+  if err != nil {
+    return nil, false, err
+  }
+
+  return body, true, nil
+}
+
+// withBody gives out a fresh reader over body
+func withBody(out *http.Request, body []byte) {
+  out.Body = ioutil.NopCloser(bytes.NewReader(body))
+  out.GetBody = func() (io.ReadCloser, error) {
+    return ioutil.NopCloser(bytes.NewReader(body)), nil
+  }
+}
+
+// retryable tells whether r may go to another backend after err. Requests
+// that never reached the backend always can; otherwise only idempotent
+// methods. Streamed bodies can't be sent twice, and nobody waits for a
+// request whose client went away.
+func retryable(r *http.Request, resendable bool, err error) bool {
+  if !resendable || r.Context().Err() != nil {
+    return false
+  }
+
+  if op, ok := err.(*net.OpError); ok && op.Op == "dial" {
+    return true
+  }
+
+  switch r.Method {
+  case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+    return true
+  }
+
+  return false
+}
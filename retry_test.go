@@ -0,0 +1,76 @@
+package knuckles
+
+import (
+  "context"
+  "errors"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+func Test_RetryResendsBody(t *testing.T) {
+  good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    body, _ := ioutil.ReadAll(r.Body)
+    w.Write(body)
+  }))
+  defer good.Close()
+
+  // reads part of the request, then hangs up without answering
+  bad, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer bad.Close()
+
+  go func() {
+    for {
+      conn, err := bad.Accept()
+      if err != nil {
+        return
+      }
+      conn.Read(make([]byte, 16))
+      conn.Close()
+    }
+  }()
+
+  s := NewMemoryStore()
+  s.AddApplication("testapp")
+  s.AddHostname("testapp", "something.com")
+  s.AddBackend("testapp", strings.TrimPrefix(good.URL, "http://"), 0, 0)
+  s.AddBackend("testapp", bad.Addr().String(), 0, 0)
+
+  h, err := NewHTTPProxy(HTTPProxyConfig{Store: s, Retries: 1})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  payload := strings.Repeat("payload ", 1000)
+
+  for i := 0; i < 10; i++ {
+    w := httptest.NewRecorder()
+    r, _ := http.NewRequest("PUT", "http://something.com/", strings.NewReader(payload))
+    h.ServeHTTP(w, r)
+
+    if w.Code != http.StatusOK || w.Body.String() != payload {
+      t.Fatal("Body not resent", w.Code, w.Body.Len())
+    }
+  }
+}
+
+func Test_RetryCanceled(t *testing.T) {
+  ctx, cancel := context.WithCancel(context.Background())
+  r, _ := http.NewRequest("GET", "http://something.com/", nil)
+  dial := &net.OpError{Op: "dial", Err: errors.New("refused")}
+
+  if !retryable(r.WithContext(ctx), true, dial) {
+    t.Fatal("Request not retried")
+  }
+
+  cancel()
+  if retryable(r.WithContext(ctx), true, dial) {
+    t.Fatal("Canceled request retried")
+  }
+}
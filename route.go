@@ -0,0 +1,59 @@
+package knuckles
+
+import "strings"
+
+// Route sends requests under Prefix on Hostname to another application.
+// With Strip the prefix is removed before proxying.
+type Route struct {
+  Hostname string `json:"hostname"`
+  Prefix   string `json:"prefix"`
+  App      string `json:"application"`
+  Strip    bool   `json:"strip"`
+}
+
+func validPrefix(prefix string) bool {
+  return strings.HasPrefix(prefix, "/")
+}
+
+// prefixMatches only matches on path segment boundaries,
+// /v2 matches /v2 and /v2/users but not /v2beta
+func prefixMatches(prefix, path string) bool {
+  if !strings.HasPrefix(path, prefix) {
+    return false
+  }
+
+  return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// longestRoute picks the route with the longest prefix matching path
+func longestRoute(routes []Route, path string) (Route, bool) {
+  var best Route
+  found := false
+
+  for _, rt := range routes {
+    if prefixMatches(rt.Prefix, path) && (!found || len(rt.Prefix) > len(best.Prefix)) {
+      best = rt
+      found = true
+    }
+  }
+
+  return best, found
+}
+
+func requestPath(ctx *RequestContext) string {
+  if ctx == nil || ctx.Request == nil || ctx.Request.URL == nil {
+    return "/"
+  }
+
+  return ctx.Request.URL.Path
+}
+
+// stripPrefix removes prefix from path keeping it absolute
+func stripPrefix(path, prefix string) string {
+  path = strings.TrimPrefix(path, prefix)
+  if !strings.HasPrefix(path, "/") {
+    path = "/" + path
+  }
+
+  return path
+}
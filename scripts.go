@@ -0,0 +1,441 @@
+package knuckles
+
+import (
+  "crypto/sha1"
+  "errors"
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Mutations touching more than one key run as Lua scripts, so a crash or
+// a concurrent call never sees them half done. Scripts get the apps set
+// as KEYS[1], the namespace and the time in milliseconds as ARGV[1] and
+// ARGV[2]. They answer a status, empty when fine, then their results.
+const luaPrelude = `
+local ns, now = ARGV[1], tonumber(ARGV[2])
+local args = {}
+for i = 3, #ARGV do args[#args + 1] = ARGV[i] end
+
+local function app_exists(app)
+  return redis.call('SISMEMBER', KEYS[1], app) == 1
+end
+
+local function state(live)
+  if live == 1 then return 'live' end
+  return 'dead'
+end
+
+local function split(member)
+  return string.match(member, '^(.-)\n(.*)$')
+end
+
+local function set_ttl(app, backend, ttl)
+  local expire = math.floor(now / 1000) + ttl
+  redis.call('SET', ns .. 'backend_ttl:' .. app .. ':' .. backend, expire)
+  redis.call('HSET', ns .. 'backend_ttl_secs:' .. app, backend, ttl)
+  redis.call('ZADD', ns .. 'backend_expiry', expire, app .. '\n' .. backend)
+end
+
+local function expired(app, backend)
+  local ttl = tonumber(redis.call('GET', ns .. 'backend_ttl:' .. app .. ':' .. backend))
+  return ttl ~= nil and ttl > 0 and math.floor(now / 1000) > ttl
+end
+
+local function ejected(app, backend)
+  local raw = redis.call('HGET', ns .. 'ejection:' .. app, backend)
+  return raw and (cjson.decode(raw).expires or 0) > now
+end
+
+local function remove_backend(app, backend)
+  local live = redis.call('SREM', ns .. 'live_backend:' .. app, backend)
+  redis.call('DEL', ns .. 'backend_ttl:' .. app .. ':' .. backend)
+  for _, hash in ipairs({'backend_weight:', 'ejection:', 'health:', 'backend_ttl_secs:'}) do
+    redis.call('HDEL', ns .. hash .. app, backend)
+  end
+  redis.call('ZREM', ns .. 'backend_expiry', app .. '\n' .. backend)
+  redis.call('SREM', ns .. 'backend:' .. app, backend)
+  return state(live)
+end
+
+-- check_backend answers the reply to give up with, nil when backend can
+-- be changed. Expired backends are removed on the way.
+local function check_backend(app, backend)
+  if not app_exists(app) then return {'no_app'} end
+  if redis.call('SISMEMBER', ns .. 'backend:' .. app, backend) == 0 then return {'no_backend'} end
+  if expired(app, backend) then return {'expired', remove_backend(app, backend)} end
+  return nil
+end
+
+local function remove_route(app, hostname, prefix)
+  local key = ns .. 'routes:' .. hostname
+  local raw = redis.call('GET', key)
+  local found, kept = false, {}
+  if raw then
+    for _, route in ipairs(cjson.decode(raw)) do
+      if route.prefix == prefix and route.application == app then
+        found = true
+      else
+        kept[#kept + 1] = route
+      end
+    end
+  end
+  if #kept == 0 then
+    redis.call('DEL', key)
+  else
+    redis.call('SET', key, cjson.encode(kept))
+  end
+  redis.call('SREM', ns .. 'app_routes:' .. app, hostname .. '\n' .. prefix)
+  return found
+end
+`
+
+// script is sent by its SHA1 once redis has seen it
+type script struct {
+  source string
+  sha    string
+}
+
+// luaScript names a script in its first line, which shows in SLOWLOG
+func luaScript(name, body string) script {
+  source := "-- " + name + "\n" + luaPrelude + body
+
+  return script{source: source, sha: fmt.Sprintf("%x", sha1.Sum([]byte(source)))}
+}
+
+var (
+  scriptAddHostname = luaScript("add_hostname", `
+local app, hostname = args[1], args[2]
+if not app_exists(app) then return {'no_app'} end
+if redis.call('SETNX', ns .. 'resolve:' .. hostname, app) == 0 then return {'hostname_exists'} end
+redis.call('SADD', ns .. 'hostname:' .. app, hostname)
+return {''}
+`)
+
+  scriptRemoveHostname = luaScript("remove_hostname", `
+local app, hostname = args[1], args[2]
+if not app_exists(app) then return {'no_app'} end
+local removed = redis.call('SREM', ns .. 'hostname:' .. app, hostname)
+-- a hostname taken over by another application stays with it
+if redis.call('GET', ns .. 'resolve:' .. hostname) == app then
+  redis.call('DEL', ns .. 'resolve:' .. hostname)
+elseif removed == 0 then
+  return {'no_hostname'}
+end
+return {''}
+`)
+
+  scriptAddBackend = luaScript("add_backend", `
+local app, backend, ttl, weight = args[1], args[2], tonumber(args[3]), tonumber(args[4])
+if not app_exists(app) then return {'no_app'} end
+if ttl > 0 then set_ttl(app, backend, ttl) end
+-- registering again keeps the weight unless a new one is given
+if weight > 0 then
+  redis.call('HSET', ns .. 'backend_weight:' .. app, backend, weight)
+else
+  redis.call('HSETNX', ns .. 'backend_weight:' .. app, backend, args[5])
+end
+return {'', tostring(redis.call('SADD', ns .. 'backend:' .. app, backend))}
+`)
+
+  scriptEnableBackend = luaScript("enable_backend", `
+local app, backend = args[1], args[2]
+local fail = check_backend(app, backend)
+if fail then return fail end
+if ejected(app, backend) then return {'ejected'} end
+return {'', tostring(redis.call('SADD', ns .. 'live_backend:' .. app, backend))}
+`)
+
+  scriptDisableBackend = luaScript("disable_backend", `
+local app, backend = args[1], args[2]
+local fail = check_backend(app, backend)
+if fail then return fail end
+return {'', tostring(redis.call('SREM', ns .. 'live_backend:' .. app, backend))}
+`)
+
+  scriptEjectBackend = luaScript("eject_backend", `
+local app, backend, ejection = args[1], args[2], args[3]
+local fail = check_backend(app, backend)
+if fail then return fail end
+redis.call('HSET', ns .. 'ejection:' .. app, backend, ejection)
+return {'', state(redis.call('SREM', ns .. 'live_backend:' .. app, backend))}
+`)
+
+  scriptSetBackendField = luaScript("set_backend_field", `
+local app, backend, hash, value = args[1], args[2], args[3], args[4]
+local fail = check_backend(app, backend)
+if fail then return fail end
+redis.call('HSET', ns .. hash .. app, backend, value)
+return {''}
+`)
+
+  scriptRenewBackend = luaScript("renew_backend", `
+local app, backend, ttl = args[1], args[2], tonumber(args[3])
+local fail = check_backend(app, backend)
+if fail then return fail end
+if ttl <= 0 then
+  ttl = tonumber(redis.call('HGET', ns .. 'backend_ttl_secs:' .. app, backend))
+end
+if not ttl or ttl <= 0 then return {'no_ttl'} end
+set_ttl(app, backend, ttl)
+return {''}
+`)
+
+  scriptRemoveBackend = luaScript("remove_backend", `
+local app, backend = args[1], args[2]
+if not app_exists(app) then return {'no_app'} end
+if redis.call('SISMEMBER', ns .. 'backend:' .. app, backend) == 0 then return {'no_backend'} end
+return {'', remove_backend(app, backend)}
+`)
+
+  scriptReapBackends = luaScript("reap_backends", `
+local key = ns .. 'backend_expiry'
+local reply = {''}
+for _, member in ipairs(redis.call('ZRANGEBYSCORE', key, '-inf', math.floor(now / 1000) - 1)) do
+  local app, backend = split(member)
+  if app and expired(app, backend) then
+    reply[#reply + 1] = app
+    reply[#reply + 1] = backend
+    reply[#reply + 1] = remove_backend(app, backend)
+  else
+    redis.call('ZREM', key, member)
+  end
+end
+return reply
+`)
+
+  // backends registered with a ttl before backend_expiry existed are
+  // only known by their backend_ttl key
+  scriptBackfillExpiry = luaScript("backfill_expiry", `
+local key = ns .. 'backend_expiry'
+local added = 0
+for _, app in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+  for _, backend in ipairs(redis.call('SMEMBERS', ns .. 'backend:' .. app)) do
+    local ttl = tonumber(redis.call('GET', ns .. 'backend_ttl:' .. app .. ':' .. backend))
+    local member = app .. '\n' .. backend
+    if ttl ~= nil and ttl > 0 and not redis.call('ZSCORE', key, member) then
+      redis.call('ZADD', key, ttl, member)
+      added = added + 1
+    end
+  end
+end
+return {'', tostring(added)}
+`)
+
+  scriptCountBackends = luaScript("count_backends", `
+local reply = {''}
+for _, app in ipairs(redis.call('SMEMBERS', KEYS[1])) do
+  reply[#reply + 1] = app
+  reply[#reply + 1] = tostring(redis.call('SCARD', ns .. 'backend:' .. app))
+  reply[#reply + 1] = tostring(redis.call('SCARD', ns .. 'live_backend:' .. app))
+end
+return reply
+`)
+
+  scriptLookupApp = luaScript("lookup_app", `
+local app = args[1]
+local live = redis.call('SMEMBERS', ns .. 'live_backend:' .. app)
+local reply = {'', tostring(#live)}
+for _, backend in ipairs(live) do
+  reply[#reply + 1] = backend
+  reply[#reply + 1] = redis.call('GET', ns .. 'backend_ttl:' .. app .. ':' .. backend) or ''
+end
+local settings = redis.call('HGETALL', ns .. 'settings:' .. app)
+reply[#reply + 1] = tostring(#settings)
+for _, value in ipairs(settings) do reply[#reply + 1] = value end
+for _, value in ipairs(redis.call('HGETALL', ns .. 'backend_weight:' .. app)) do
+  reply[#reply + 1] = value
+end
+return reply
+`)
+
+  scriptRemoveApplication = luaScript("remove_application", `
+local app = args[1]
+if not app_exists(app) then return {'no_app'} end
+local reply = {''}
+for _, backend in ipairs(redis.call('SMEMBERS', ns .. 'backend:' .. app)) do
+  reply[#reply + 1] = backend
+  reply[#reply + 1] = remove_backend(app, backend)
+end
+for _, hostname in ipairs(redis.call('SMEMBERS', ns .. 'hostname:' .. app)) do
+  if redis.call('GET', ns .. 'resolve:' .. hostname) == app then
+    redis.call('DEL', ns .. 'resolve:' .. hostname)
+  end
+end
+for _, member in ipairs(redis.call('SMEMBERS', ns .. 'app_routes:' .. app)) do
+  local hostname, prefix = split(member)
+  if hostname then remove_route(app, hostname, prefix) end
+end
+for _, key in ipairs({'hostname:', 'settings:', 'app_routes:', 'backend:', 'live_backend:',
+    'backend_weight:', 'ejection:', 'health:', 'backend_ttl_secs:', 'error_pages:'}) do
+  redis.call('DEL', ns .. key .. app)
+end
+redis.call('SREM', KEYS[1], app)
+return reply
+`)
+
+  scriptAddRoute = luaScript("add_route", `
+local app, hostname, prefix, route = args[1], args[2], args[3], args[4]
+if not app_exists(app) then return {'no_app'} end
+local key = ns .. 'routes:' .. hostname
+local routes = {}
+local raw = redis.call('GET', key)
+if raw then routes = cjson.decode(raw) end
+for _, rt in ipairs(routes) do
+  if rt.prefix == prefix then return {'route_exists'} end
+end
+routes[#routes + 1] = cjson.decode(route)
+redis.call('SET', key, cjson.encode(routes))
+redis.call('SADD', ns .. 'app_routes:' .. app, hostname .. '\n' .. prefix)
+return {''}
+`)
+
+  scriptRemoveRoute = luaScript("remove_route", `
+local app, hostname, prefix = args[1], args[2], args[3]
+if not app_exists(app) then return {'no_app'} end
+if not remove_route(app, hostname, prefix) then return {'no_route'} end
+return {''}
+`)
+
+  scriptSetSettings = luaScript("set_settings", `
+local app = args[1]
+if not app_exists(app) then return {'no_app'} end
+for i = 2, #args - 1, 2 do
+  redis.call('HSET', ns .. 'settings:' .. app, args[i], args[i + 1])
+end
+return {''}
+`)
+
+  scriptSetErrorPage = luaScript("set_error_page", `
+local app, kind, body = args[1], args[2], args[3]
+if not app_exists(app) then return {'no_app'} end
+redis.call('HSET', ns .. 'error_pages:' .. app, kind, body)
+return {''}
+`)
+
+  scriptRemoveErrorPage = luaScript("remove_error_page", `
+local app, kind = args[1], args[2]
+if not app_exists(app) then return {'no_app'} end
+if redis.call('HDEL', ns .. 'error_pages:' .. app, kind) == 0 then return {'no_error_page'} end
+return {''}
+`)
+
+  scriptSetCertificate = luaScript("set_certificate", `
+local hostname, cert, key = args[1], args[2], args[3]
+redis.call('MSET', ns .. 'cert:' .. hostname, cert, ns .. 'cert_key:' .. hostname, key)
+return {''}
+`)
+
+  scriptAcquireLease = luaScript("acquire_lease", `
+local key, owner, ttl = ns .. 'lease:' .. args[1], args[2], args[3]
+local holder = redis.call('GET', key)
+if holder and holder ~= owner then return {'', '0'} end
+redis.call('SET', key, owner, 'PX', ttl)
+return {'', '1'}
+`)
+
+  scriptReleaseLease = luaScript("release_lease", `
+local key, owner = ns .. 'lease:' .. args[1], args[2]
+if redis.call('GET', key) == owner then redis.call('DEL', key) end
+return {''}
+`)
+
+  scriptJoinGroup = luaScript("join_group", `
+local key, member, ttl = ns .. 'group:' .. args[1], args[2], tonumber(args[3])
+redis.call('ZREMRANGEBYSCORE', key, '-inf', '(' .. now)
+redis.call('ZADD', key, now + ttl, member)
+return {''}
+`)
+)
+
+// errExpired tells the backend a script was given has just been removed
+// because its ttl ran out
+var errExpired = errors.New("Backend expired")
+
+var scriptErrors = map[string]error{
+  "no_app":          ErrNoApp,
+  "no_backend":      ErrNoBackend,
+  "no_hostname":     ErrNoHostname,
+  "no_route":        ErrNoRoute,
+  "no_ttl":          ErrNoTTL,
+  "no_error_page":   ErrNoErrorPage,
+  "hostname_exists": ErrHostnameAlreadyExists,
+  "route_exists":    ErrRouteAlreadyExists,
+  "ejected":         ErrBackendEjected,
+  "expired":         errExpired,
+}
+
+// eval runs s with args, answering the results after the status. The
+// source is only sent when redis doesn't have the script cached yet.
+func (r *RedisStore) eval(s script, args ...string) ([]string, error) {
+  now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+  argv := append([]string{r.namespace, now}, args...)
+  keys := []string{r.Key("apps")}
+
+  reply, err := r.client.EvalSha(s.sha, 1, keys, argv)
+  if err != nil && strings.Contains(err.Error(), "NOSCRIPT") {
+    reply, err = r.client.Eval(s.source, 1, keys, argv)
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  values, err := scriptReply(reply)
+  if err != nil {
+    return nil, err
+  }
+
+  if values[0] != "" {
+    err, ok := scriptErrors[values[0]]
+    if !ok {
+      err = ErrScriptReply
+    }
+    return values[1:], err
+  }
+
+  return values[1:], nil
+}
+
+// evalBackend runs a script changing backend, which goes away instead
+// when its ttl ran out
+func (r *RedisStore) evalBackend(s script, app, backend string, args ...string) ([]string, error) {
+  values, err := r.eval(s, append([]string{app, backend}, args...)...)
+
+  if err == errExpired {
+    var old string
+    if len(values) > 0 {
+      old = values[0]
+    }
+    r.notify(Event{Type: EventBackendRemoved, App: app, Backend: backend, Old: old, Reason: "ttl expired"})
+    return nil, ErrNoBackend
+  }
+
+  return values, err
+}
+
+func scriptReply(reply interface{}) ([]string, error) {
+  var values []string
+
+  switch v := reply.(type) {
+  case []string:
+    values = v
+  case []interface{}:
+    for _, e := range v {
+      switch e := e.(type) {
+      case string:
+        values = append(values, e)
+      case []byte:
+        values = append(values, string(e))
+      default:
+        return nil, ErrScriptReply
+      }
+    }
+  }
+
+  if len(values) == 0 {
+    return nil, ErrScriptReply
+  }
+
+  return values, nil
+}
@@ -1,25 +1,56 @@
 package knuckles
 
 import (
+  "encoding/json"
   "fmt"
   "github.com/fiorix/go-redis/redis"
+  "sort"
   "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
   "time"
 )
 
 type Endpoint struct {
-  addr string
+  addr   string
+  app    string
+  sticky bool
+  strip  string
+}
+
+type BackendInfo struct {
+  Alive       bool       `json:"alive"`
+  Weight      int        `json:"weight"`
+  Ejection    *Ejection  `json:"ejection,omitempty"`
+  Flapping    bool       `json:"flapping"`
+  CertExpires *time.Time `json:"cert_expires,omitempty"`
+}
+
+const DefaultWeight = 1
+
+// BackendCount is how many backends an application has, and how many of
+// them are live
+type BackendCount struct {
+  Total int
+  Live  int
 }
 
 type Store interface {
-  EndpointForHostname(name string) (Endpoint, error)
+  EndpointForHostname(name string, ctx *RequestContext) (Endpoint, error)
 
   AddApplication(app string) error
   AddHostname(app, hostname string) error
-  AddBackend(app, backend string, ttl int) error
+  AddBackend(app, backend string, ttl, weight int) error
+  RenewBackend(app, backend string, ttl int) error
+  SetBackendWeight(app, backend string, weight int) error
+
+  EnableBackend(app, backend, reason string) error
+  DisableBackend(app, backend, reason string) error
+  EjectBackend(app, backend, reason string, cooldown time.Duration) error
 
-  EnableBackend(app, backend string) error
-  DisableBackend(app, backend string) error
+  BackendHealth(app, backend string) (HealthState, error)
+  SetBackendHealth(app, backend string, state HealthState) error
 
   HostnamesForApp(app string) ([]string, error)
   BackendsForApp(app string) ([]string, error)
@@ -28,18 +59,63 @@ type Store interface {
   RemoveHostname(app, hostname string) error
   RemoveBackend(app, backend string) error
 
+  SetStrategy(app string, strategy Strategy) error
+  StrategyForApp(app string) (Strategy, error)
+
+  SetAffinity(app string, enabled bool) error
+  AffinityForApp(app string) (bool, error)
+
+  SetHealthCheck(app string, check HealthCheck) error
+  HealthCheckForApp(app string) (HealthCheck, error)
+
+  SetErrorPage(app, kind, body string) error
+  RemoveErrorPage(app, kind string) error
+  ErrorPageForApp(app, kind string) (string, error)
+
+  AddRoute(app, hostname, prefix string, strip bool) error
+  RemoveRoute(app, hostname, prefix string) error
+  RoutesForApp(app string) ([]Route, error)
+
+  SetCertificate(hostname, cert, key string) error
+  RemoveCertificate(hostname string) error
+  CertificateForHostname(name string) (string, string, error)
+
+  AcquireLease(name, owner string, ttl time.Duration) (bool, error)
+  ReleaseLease(name, owner string) error
+
+  JoinGroup(group, member string, ttl time.Duration) error
+  LeaveGroup(group, member string) error
+  GroupMembers(group string) ([]string, error)
+
+  Subscribe(ch chan Event)
+  Unsubscribe(ch chan Event)
+
+  ReapBackends() (int, error)
+
   ListApplications() ([]string, error)
-  DescribeApplication(app string) ([]string, map[string]bool, error)
+  DescribeApplication(app string) ([]string, map[string]BackendInfo, error)
+  CountBackends() (map[string]BackendCount, error)
+
+  Ping() error
 }
 
 type RedisStore struct {
-  client    *redis.Client
-  namespace string
+  client      *redis.Client
+  host        string
+  namespace   string
+  balancer    *Balancer
+  cache       *resolveCache
+  subscribers eventSubscribers
+  watchOnce   sync.Once
+  watching    int32
+  backfilled  int32
 }
 
 func NewRedisStore(namespace string, host string) (*RedisStore, error) {
   r := &RedisStore{
     namespace: namespace,
+    host:      host,
+    balancer:  NewBalancer(),
   }
 
   r.client = redis.New(host)
@@ -47,31 +123,198 @@ func NewRedisStore(namespace string, host string) (*RedisStore, error) {
   return r, nil
 }
 
-func (r *RedisStore) EndpointForHostname(name string) (Endpoint, error) {
+// EnableCache keeps hostname and backend lookups in process, invalidated
+// by the events every mutation publishes. ttl bounds staleness. Lookups
+// skip the cache until the events subscription is in place.
+func (r *RedisStore) EnableCache(ttl time.Duration) {
+  r.cache = newResolveCache(ttl)
+  r.cache.pause()
+  if atomic.LoadInt32(&r.watching) == 1 {
+    r.cache.resume()
+  }
+  r.startWatch()
+}
+
+func (r *RedisStore) CacheStats() CacheStats {
+  if r.cache == nil {
+    return CacheStats{}
+  }
+
+  return r.cache.stats()
+}
+
+// Ping checks redis answers
+func (r *RedisStore) Ping() error {
+  return r.client.Ping()
+}
+
+func (r *RedisStore) EndpointForHostname(name string, ctx *RequestContext) (Endpoint, error) {
   var epoint Endpoint
-  appName, err := r.client.Get(r.Key("resolve:%s", name))
+
+  host, err := r.lookupHost(name)
 
   if err != nil {
     return epoint, err
   }
 
-  if appName == "" {
-    return epoint, ErrNoHostname
+  appName, route, err := host.resolve(requestPath(ctx))
+
+  if err != nil {
+    return epoint, err
+  }
+
+  if route.Strip {
+    epoint.strip = route.Prefix
   }
 
-  members, err := r.client.SRandMember(r.Key("live_backend:%s", appName), 1)
+  // known even without backends, for the error page
+  epoint.app = appName
+
+  app, err := r.lookupApp(appName)
 
   if err != nil {
     return epoint, err
   }
 
-  if len(members) != 1 {
+  live := candidates(unexpired(app.live, app.ttls, time.Now()), ctx)
+
+  if len(live) == 0 {
     return epoint, ErrNoBackend
   }
 
-  epoint.addr = members[0]
+  epoint.sticky = app.settings["affinity"] == "1"
 
-  return epoint, nil
+  if epoint.sticky {
+    if pinned, ok := pinnedBackend(appName, live, ctx); ok {
+      epoint.addr = pinned
+      return epoint, nil
+    }
+  }
+
+  epoint.addr, err = r.balancer.Pick(appName, strategyFromSettings(app.settings), live, app.weights, ctx)
+
+  return epoint, err
+}
+
+// lookupHost fetches every candidate entry and its routes in a single round trip
+func (r *RedisStore) lookupHost(name string) (hostEntry, error) {
+  var e hostEntry
+  var gen uint64
+
+  if r.cache != nil {
+    if cached, ok := r.cache.host(name); ok {
+      return cached, nil
+    }
+    gen = r.cache.generation()
+  }
+
+  candidates := hostnameCandidates(name)
+  keys := make([]string, 0, 2*len(candidates))
+  for _, c := range candidates {
+    keys = append(keys, r.Key("resolve:%s", c), r.Key("routes:%s", c))
+  }
+
+  values, err := r.client.MGet(keys...)
+  if err != nil {
+    return e, err
+  }
+
+  for i := 0; i+1 < len(values); i += 2 {
+    var routes []Route
+
+    if values[i+1] != "" {
+      err = json.Unmarshal([]byte(values[i+1]), &routes)
+      if err != nil {
+        return e, err
+      }
+    }
+
+    e.apps = append(e.apps, values[i])
+    e.routes = append(e.routes, routes)
+  }
+
+  if r.cache != nil {
+    r.cache.setHost(name, e, gen)
+  }
+
+  return e, nil
+}
+
+func (r *RedisStore) lookupApp(app string) (appEntry, error) {
+  var e appEntry
+  var err error
+  var gen uint64
+
+  if r.cache != nil {
+    if cached, ok := r.cache.app(app); ok {
+      return cached, nil
+    }
+    gen = r.cache.generation()
+  }
+
+  values, err := r.eval(scriptLookupApp, app)
+  if err != nil {
+    return e, err
+  }
+
+  e, err = appEntryFromReply(values)
+  if err != nil {
+    return e, err
+  }
+
+  if r.cache != nil {
+    r.cache.setApp(app, e, gen)
+  }
+
+  return e, nil
+}
+
+// appEntryFromReply reads what lookup_app answers: the number of live
+// backends, each followed by its expiry, the number of settings fields,
+// the settings, then the weights
+func appEntryFromReply(values []string) (appEntry, error) {
+  e := appEntry{
+    ttls:     make(map[string]int),
+    settings: make(map[string]string),
+    weights:  make(map[string]int),
+  }
+
+  next := func() (int, bool) {
+    if len(values) == 0 {
+      return 0, false
+    }
+    n, err := strconv.Atoi(values[0])
+    values = values[1:]
+    return n, err == nil && n >= 0
+  }
+
+  n, ok := next()
+  if !ok || len(values) < 2*n {
+    return e, ErrScriptReply
+  }
+  for i := 0; i < n; i++ {
+    backend := values[2*i]
+    e.live = append(e.live, backend)
+    if ttl, err := strconv.Atoi(values[2*i+1]); err == nil {
+      e.ttls[backend] = ttl
+    }
+  }
+  values = values[2*n:]
+
+  n, ok = next()
+  if !ok || n%2 != 0 || len(values) < n {
+    return e, ErrScriptReply
+  }
+  for i := 0; i+1 < n; i += 2 {
+    e.settings[values[i]] = values[i+1]
+  }
+  values = values[n:]
+
+  for i := 0; i+1 < len(values); i += 2 {
+    e.weights[values[i]], _ = strconv.Atoi(values[i+1])
+  }
+
+  return e, nil
 }
 
 func (r *RedisStore) Key(format string, args ...interface{}) string {
@@ -89,6 +332,8 @@ func (r *RedisStore) AddApplication(app string) error {
     return ErrAppAlreadyExists
   }
 
+  r.notify(Event{Type: EventApplicationAdded, App: app})
+
   return nil
 }
 
@@ -104,206 +349,590 @@ func (r *RedisStore) isValidApp(app string) error {
   return nil
 }
 
-func (r *RedisStore) isValidBackend(app, backend string) error {
-  ismember, err := r.client.SIsMember(r.Key("backend:%s", app), backend)
+func (r *RedisStore) EnableBackend(app, backend, reason string) error {
+  values, err := r.evalBackend(scriptEnableBackend, app, backend)
   if err != nil {
     return err
   }
-  if ismember == 0 {
-    return ErrNoBackend
+
+  if values[0] == "1" {
+    r.notify(Event{Type: EventBackendEnabled, App: app, Backend: backend, Old: StateDead, New: StateLive, Reason: reason})
   }
 
-  // check if this guy needs to be removed (ttl)
-  rawTTL, err := r.client.Get(r.Key("backend_ttl:%s:%s", app, backend))
+  return nil
+}
+
+func (r *RedisStore) DisableBackend(app, backend, reason string) error {
+  values, err := r.evalBackend(scriptDisableBackend, app, backend)
   if err != nil {
     return err
   }
 
-  // if the backend has been dead for more than X seconds
-  // and it hasn't pinged us, get rid of it
-  if rawTTL != "" {
-    now := int(time.Now().Unix())
-    ttl, err := strconv.Atoi(rawTTL)
-    if err == nil {
-      if now > ttl {
-        err = r.RemoveBackend(app, backend)
-
-        if err != nil {
-          return err
-        }
-        //make sure this backend doesn't get activated
-        return ErrNoBackend
-      }
-    }
+  if values[0] == "1" {
+    r.notify(Event{Type: EventBackendDisabled, App: app, Backend: backend, Old: StateLive, New: StateDead, Reason: reason})
   }
 
   return nil
 }
 
-func (r *RedisStore) EnableBackend(app, backend string) error {
-  err := r.isValidApp(app)
+// storedEjection carries the end of the cooldown in milliseconds, for scripts
+type storedEjection struct {
+  Ejection
+  Expires int64 `json:"expires"`
+}
+
+// EjectBackend disables backend, refusing to enable it again for cooldown
+func (r *RedisStore) EjectBackend(app, backend, reason string, cooldown time.Duration) error {
+  until := time.Now().Add(cooldown)
+
+  raw, err := json.Marshal(storedEjection{
+    Ejection: Ejection{Reason: reason, Until: until},
+    Expires:  until.UnixNano() / int64(time.Millisecond),
+  })
+  if err != nil {
+    return err
+  }
+
+  values, err := r.evalBackend(scriptEjectBackend, app, backend, string(raw))
   if err != nil {
     return err
   }
 
-  err = r.isValidBackend(app, backend)
+  r.notify(Event{Type: EventBackendEjected, App: app, Backend: backend, Old: values[0], New: StateDead, Reason: reason})
+
+  return nil
+}
+
+func (r *RedisStore) BackendHealth(app, backend string) (HealthState, error) {
+  var state HealthState
+
+  raw, err := r.client.HGet(r.Key("health:%s", app), backend)
+  if err != nil || raw == "" {
+    return state, err
+  }
+
+  json.Unmarshal([]byte(raw), &state)
+
+  return state, nil
+}
+
+func (r *RedisStore) SetBackendHealth(app, backend string, state HealthState) error {
+  raw, err := json.Marshal(state)
   if err != nil {
     return err
   }
 
-  _, err = r.client.SAdd(r.Key("live_backend:%s", app), backend)
+  _, err = r.evalBackend(scriptSetBackendField, app, backend, "health:", string(raw))
 
   return err
 }
 
-func (r *RedisStore) DisableBackend(app, backend string) error {
-  err := r.isValidApp(app)
+// ejection is the last ejection of backend, nil if it never was
+func (r *RedisStore) ejection(app, backend string) (*Ejection, error) {
+  raw, err := r.client.HGet(r.Key("ejection:%s", app), backend)
+  if err != nil || raw == "" {
+    return nil, err
+  }
+
+  var e Ejection
+  if json.Unmarshal([]byte(raw), &e) != nil {
+    return nil, nil
+  }
+
+  return &e, nil
+}
+
+func (r *RedisStore) AddHostname(app, hostname string) error {
+  if !validHostname(hostname) {
+    return ErrInvalidHostname
+  }
+
+  _, err := r.eval(scriptAddHostname, app, hostname)
   if err != nil {
     return err
   }
 
-  err = r.isValidBackend(app, backend)
+  r.notify(Event{Type: EventHostnameAdded, App: app, Hostname: hostname})
+
+  return nil
+}
+
+// AddBackend registers backend, enabled unless it is ejected. Registering
+// it again refreshes its ttl and, when weight is given, its weight, and
+// leaves it live or dead as it was.
+func (r *RedisStore) AddBackend(app, backend string, ttl, weight int) error {
+  if weight < 0 {
+    weight = 0
+  }
+
+  values, err := r.eval(scriptAddBackend, app, backend, strconv.Itoa(ttl), strconv.Itoa(weight), strconv.Itoa(DefaultWeight))
   if err != nil {
     return err
   }
 
-  _, err = r.client.SRem(r.Key("live_backend:%s", app), backend)
+  r.notify(Event{Type: EventBackendAdded, App: app, Backend: backend})
+
+  if len(values) == 0 || values[0] != "1" {
+    return nil
+  }
+
+  // ejected backends are registered but stay out until the cooldown is over
+  err = r.EnableBackend(app, backend, "added")
+  if err == ErrBackendEjected {
+    return nil
+  }
+
+  return err
+}
+
+// RenewBackend is the heartbeat of a backend registered with a ttl. It
+// pushes the expiry ttl seconds away, or by the last ttl when ttl is 0,
+// leaving everything else alone. Expired backends must register again.
+func (r *RedisStore) RenewBackend(app, backend string, ttl int) error {
+  _, err := r.evalBackend(scriptRenewBackend, app, backend, strconv.Itoa(ttl))
 
   return err
 }
 
-func (r *RedisStore) AddHostname(app, hostname string) error {
-  err := r.isValidApp(app)
+// ReapBackends removes every backend whose ttl ran out, returning how
+// many. Expiries are kept in the backend_expiry sorted set.
+func (r *RedisStore) ReapBackends() (int, error) {
+  // the first pass also picks up backends registered before backend_expiry
+  if atomic.LoadInt32(&r.backfilled) == 0 {
+    _, err := r.eval(scriptBackfillExpiry)
+    if err != nil {
+      return 0, err
+    }
+    atomic.StoreInt32(&r.backfilled, 1)
+  }
+
+  values, err := r.eval(scriptReapBackends)
+  if err != nil {
+    return 0, err
+  }
+
+  reaped := 0
+  for i := 0; i+2 < len(values); i += 3 {
+    r.notify(Event{Type: EventBackendRemoved, App: values[i], Backend: values[i+1], Old: values[i+2], Reason: "ttl expired"})
+    reaped++
+  }
+
+  return reaped, nil
+}
+
+func (r *RedisStore) SetBackendWeight(app, backend string, weight int) error {
+  if weight <= 0 {
+    return ErrInvalidWeight
+  }
+
+  _, err := r.evalBackend(scriptSetBackendField, app, backend, "backend_weight:", strconv.Itoa(weight))
   if err != nil {
     return err
   }
 
-  ok, err := r.client.SetNx(r.Key("resolve:%s", hostname), app)
+  r.notify(Event{Type: EventBackendWeight, App: app, Backend: backend})
+
+  return nil
+}
+
+func (r *RedisStore) weights(app string) (map[string]int, error) {
+  raw, err := r.client.HGetAll(r.Key("backend_weight:%s", app))
+  if err != nil {
+    return nil, err
+  }
+
+  weights := make(map[string]int, len(raw))
+  for backend, w := range raw {
+    weights[backend], _ = strconv.Atoi(w)
+  }
+
+  return weights, nil
+}
+
+func (r *RedisStore) HostnamesForApp(app string) ([]string, error) {
+  return r.client.SMembers(r.Key("hostname:%s", app))
+}
+
+func (r *RedisStore) BackendsForApp(app string) ([]string, error) {
+  return r.client.SMembers(r.Key("backend:%s", app))
+}
 
+func (r *RedisStore) RemoveBackend(app, backend string) error {
+  values, err := r.eval(scriptRemoveBackend, app, backend)
   if err != nil {
     return err
   }
 
-  if ok == 0 {
-    return ErrHostnameAlreadyExists
+  r.notify(Event{Type: EventBackendRemoved, App: app, Backend: backend, Old: values[0]})
+
+  return nil
+}
+
+func (r *RedisStore) RemoveHostname(app, hostname string) error {
+  _, err := r.eval(scriptRemoveHostname, app, hostname)
+  if err != nil {
+    return err
   }
 
-  _, err = r.client.SAdd(r.Key("hostname:%s", app), hostname)
+  r.notify(Event{Type: EventHostnameRemoved, App: app, Hostname: hostname})
 
-  return err
+  return nil
 }
 
-func (r *RedisStore) AddBackend(app, backend string, ttl int) error {
-  err := r.isValidApp(app)
+// RemoveApplication drops app with its hostnames, backends and routes
+func (r *RedisStore) RemoveApplication(app string) error {
+  values, err := r.eval(scriptRemoveApplication, app)
+  if err != nil {
+    return err
+  }
+
+  for i := 0; i+1 < len(values); i += 2 {
+    r.notify(Event{Type: EventBackendRemoved, App: app, Backend: values[i], Old: values[i+1]})
+  }
+
+  r.notify(Event{Type: EventApplicationRemoved, App: app})
+
+  return nil
+}
+
+func (r *RedisStore) hostnameRoutes(hostname string) ([]Route, error) {
+  var routes []Route
+
+  raw, err := r.client.Get(r.Key("routes:%s", hostname))
+  if err != nil || raw == "" {
+    return routes, err
+  }
+
+  err = json.Unmarshal([]byte(raw), &routes)
+
+  return routes, err
+}
+
+func (r *RedisStore) AddRoute(app, hostname, prefix string, strip bool) error {
+  if !validHostname(hostname) {
+    return ErrInvalidHostname
+  }
+
+  if !validPrefix(prefix) {
+    return ErrInvalidPrefix
+  }
+
+  raw, err := json.Marshal(Route{Hostname: hostname, Prefix: prefix, App: app, Strip: strip})
   if err != nil {
     return err
   }
 
-  ismember, err := r.client.SIsMember(r.Key("backends:%s", app), backend)
+  _, err = r.eval(scriptAddRoute, app, hostname, prefix, string(raw))
+  if err != nil {
+    return err
+  }
+
+  r.notify(Event{Type: EventRouteAdded, App: app, Hostname: hostname})
+
+  return nil
+}
 
+func (r *RedisStore) RemoveRoute(app, hostname, prefix string) error {
+  _, err := r.eval(scriptRemoveRoute, app, hostname, prefix)
   if err != nil {
     return err
   }
 
-  if ismember == 1 {
-    return ErrBackendAlreadyExists
+  r.notify(Event{Type: EventRouteRemoved, App: app, Hostname: hostname})
+
+  return nil
+}
+
+func (r *RedisStore) RoutesForApp(app string) ([]Route, error) {
+  var routes []Route
+
+  members, err := r.client.SMembers(r.Key("app_routes:%s", app))
+  if err != nil {
+    return routes, err
   }
 
-  if ttl > 0 {
-    expire := int(time.Now().Unix()) + ttl
-    err = r.client.Set(r.Key("backend_ttl:%s:%s", app, backend), strconv.Itoa(expire))
+  for _, m := range members {
+    hostname := strings.SplitN(m, "\n", 2)[0]
 
+    hostRoutes, err := r.hostnameRoutes(hostname)
     if err != nil {
-      return err
+      return routes, err
     }
+
+    for _, rt := range hostRoutes {
+      if rt.App == app && hostname+"\n"+rt.Prefix == m {
+        routes = append(routes, rt)
+      }
+    }
+  }
+
+  return routes, nil
+}
+
+func (r *RedisStore) SetStrategy(app string, strategy Strategy) error {
+  err := strategy.Validate()
+  if err != nil {
+    return err
   }
 
-  _, err = r.client.SAdd(r.Key("backend:%s", app), backend)
+  _, err = r.eval(scriptSetSettings, app, "strategy", strategy.Name, "strategy_key", strategy.Key)
   if err != nil {
     return err
   }
 
-  return r.EnableBackend(app, backend)
+  r.notify(Event{Type: EventSettings, App: app})
+
+  return nil
 }
 
-func (r *RedisStore) HostnamesForApp(app string) ([]string, error) {
-  return r.client.SMembers(r.Key("hostname:%s", app))
+func (r *RedisStore) StrategyForApp(app string) (Strategy, error) {
+  settings, err := r.settings(app)
+  if err != nil {
+    return DefaultStrategy(), err
+  }
+
+  return strategyFromSettings(settings), nil
 }
 
-func (r *RedisStore) BackendsForApp(app string) ([]string, error) {
-  return r.client.SMembers(r.Key("backend:%s", app))
+func (r *RedisStore) SetAffinity(app string, enabled bool) error {
+  value := "0"
+  if enabled {
+    value = "1"
+  }
+
+  _, err := r.eval(scriptSetSettings, app, "affinity", value)
+  if err != nil {
+    return err
+  }
+
+  r.notify(Event{Type: EventSettings, App: app})
+
+  return nil
 }
 
-func (r *RedisStore) RemoveBackend(app, backend string) error {
-  err := r.isValidApp(app)
+func (r *RedisStore) AffinityForApp(app string) (bool, error) {
+  settings, err := r.settings(app)
+  if err != nil {
+    return false, err
+  }
+
+  return settings["affinity"] == "1", nil
+}
+
+func (r *RedisStore) SetHealthCheck(app string, check HealthCheck) error {
+  err := check.Validate()
   if err != nil {
     return err
   }
 
-  _, err = r.client.Del(r.Key("backend_ttl:%s:%s", app, backend))
+  raw, err := json.Marshal(check)
   if err != nil {
     return err
   }
 
-  _, err = r.client.SRem(r.Key("live_backend:%s", app), backend)
+  _, err = r.eval(scriptSetSettings, app, "health_check", string(raw))
   if err != nil {
     return err
   }
 
-  _, err = r.client.SRem(r.Key("backend:%s", app), backend)
-  return err
+  r.notify(Event{Type: EventSettings, App: app})
+
+  return nil
 }
 
-func (r *RedisStore) RemoveHostname(app, hostname string) error {
-  err := r.isValidApp(app)
+func (r *RedisStore) HealthCheckForApp(app string) (HealthCheck, error) {
+  check := DefaultHealthCheck()
+
+  raw, err := r.client.HGet(r.Key("settings:%s", app), "health_check")
+  if err != nil || raw == "" {
+    return check, err
+  }
+
+  if json.Unmarshal([]byte(raw), &check) != nil {
+    return DefaultHealthCheck(), nil
+  }
+
+  return check, nil
+}
+
+// SetErrorPage overrides the listener error page of kind for app, body
+// is an html/template executed with an ErrorPage
+func (r *RedisStore) SetErrorPage(app, kind, body string) error {
+  err := validErrorPage(kind, body)
+  if err != nil {
+    return err
+  }
+
+  _, err = r.eval(scriptSetErrorPage, app, kind, body)
   if err != nil {
     return err
   }
 
-  _, err = r.client.SRem(r.Key("hostname:%s", app), hostname)
+  r.notify(Event{Type: EventSettings, App: app})
 
+  return nil
+}
+
+func (r *RedisStore) RemoveErrorPage(app, kind string) error {
+  _, err := r.eval(scriptRemoveErrorPage, app, kind)
   if err != nil {
     return err
   }
 
-  _, err = r.client.Del(r.Key("resolve:%s", hostname))
-  return err
+  r.notify(Event{Type: EventSettings, App: app})
+
+  return nil
 }
 
-func (r *RedisStore) RemoveApplication(app string) error {
-  err := r.isValidApp(app)
+// ErrorPageForApp is the page body app overrides kind with, empty if none
+func (r *RedisStore) ErrorPageForApp(app, kind string) (string, error) {
+  return r.client.HGet(r.Key("error_pages:%s", app), kind)
+}
+
+func (r *RedisStore) settings(app string) (map[string]string, error) {
+  return r.client.HGetAll(r.Key("settings:%s", app))
+}
+
+func strategyFromSettings(settings map[string]string) Strategy {
+  strategy := DefaultStrategy()
+
+  if settings["strategy"] != "" {
+    strategy.Name = settings["strategy"]
+    strategy.Key = settings["strategy_key"]
+  }
+
+  return strategy
+}
+
+func (r *RedisStore) SetCertificate(hostname, cert, key string) error {
+  if !validHostname(hostname) {
+    return ErrInvalidHostname
+  }
+
+  err := validCertificate(cert, key)
   if err != nil {
     return err
   }
-  _, err = r.client.Del(r.Key("backend:%s", app))
+
+  _, err = r.eval(scriptSetCertificate, hostname, cert, key)
   if err != nil {
     return err
   }
 
-  hostnames, err := r.HostnamesForApp(app)
-  for _, h := range hostnames {
-    _, err = r.client.Del(r.Key("resolve:%s", h))
-    if err != nil {
-      return err
+  r.notify(Event{Type: EventCertificateAdded, Hostname: hostname})
+
+  return nil
+}
+
+func (r *RedisStore) RemoveCertificate(hostname string) error {
+  n, err := r.client.Del(r.Key("cert:%s", hostname), r.Key("cert_key:%s", hostname))
+  if err != nil {
+    return err
+  }
+
+  if n == 0 {
+    return ErrNoCertificate
+  }
+
+  r.notify(Event{Type: EventCertificateRemoved, Hostname: hostname})
+
+  return nil
+}
+
+// CertificateForHostname resolves like hostnames, wildcards included
+func (r *RedisStore) CertificateForHostname(name string) (string, string, error) {
+  candidates := hostnameCandidates(name)
+  keys := make([]string, 0, 2*len(candidates))
+  for _, c := range candidates {
+    keys = append(keys, r.Key("cert:%s", c), r.Key("cert_key:%s", c))
+  }
+
+  values, err := r.client.MGet(keys...)
+  if err != nil {
+    return "", "", err
+  }
+
+  for i := 0; i+1 < len(values); i += 2 {
+    if values[i] != "" && values[i+1] != "" {
+      return values[i], values[i+1], nil
     }
   }
 
-  _, err = r.client.Del(r.Key("hostname:%s", app))
+  return "", "", ErrNoCertificate
+}
+
+// AcquireLease takes the lease called name for owner, or extends it when
+// owner already holds it. Leases not renewed within ttl go away.
+func (r *RedisStore) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+  ms := int64((ttl + time.Millisecond - 1) / time.Millisecond)
+
+  values, err := r.eval(scriptAcquireLease, name, owner, strconv.FormatInt(ms, 10))
   if err != nil {
-    return err
+    return false, err
   }
 
-  _, err = r.client.SRem(r.Key("apps"), app)
+  return values[0] == "1", nil
+}
+
+func (r *RedisStore) ReleaseLease(name, owner string) error {
+  _, err := r.eval(scriptReleaseLease, name, owner)
+
+  return err
+}
+
+// JoinGroup keeps member in group for ttl, members are scored by the
+// millisecond they expire at
+func (r *RedisStore) JoinGroup(group, member string, ttl time.Duration) error {
+  ms := int64((ttl + time.Millisecond - 1) / time.Millisecond)
+
+  _, err := r.eval(scriptJoinGroup, group, member, strconv.FormatInt(ms, 10))
+
+  return err
+}
+
+func (r *RedisStore) LeaveGroup(group, member string) error {
+  _, err := r.client.ZRem(r.Key("group:%s", group), member)
+
   return err
 }
 
+func (r *RedisStore) GroupMembers(group string) ([]string, error) {
+  now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+
+  members, err := r.client.ZRangeByScore(r.Key("group:%s", group), now, "+inf", false, false, 0, 0)
+  if err != nil {
+    return nil, err
+  }
+  sort.Strings(members)
+
+  return members, nil
+}
+
 func (r *RedisStore) ListApplications() ([]string, error) {
   return r.client.SMembers(r.Key("apps"))
 }
 
-func (r *RedisStore) DescribeApplication(app string) ([]string, map[string]bool, error) {
+// CountBackends counts the backends of every application in one round trip
+func (r *RedisStore) CountBackends() (map[string]BackendCount, error) {
+  counts := make(map[string]BackendCount)
+
+  values, err := r.eval(scriptCountBackends)
+  if err != nil {
+    return counts, err
+  }
+
+  for i := 0; i+2 < len(values); i += 3 {
+    total, _ := strconv.Atoi(values[i+1])
+    live, _ := strconv.Atoi(values[i+2])
+    counts[values[i]] = BackendCount{Total: total, Live: live}
+  }
+
+  return counts, nil
+}
+
+func (r *RedisStore) DescribeApplication(app string) ([]string, map[string]BackendInfo, error) {
   var hostnames []string
-  var backends = make(map[string]bool)
+  var backends = make(map[string]BackendInfo)
 
   err := r.isValidApp(app)
   if err != nil {
@@ -320,16 +949,33 @@ func (r *RedisStore) DescribeApplication(app string) ([]string, map[string]bool,
     return hostnames, backends, err
   }
 
+  weights, err := r.weights(app)
+  if err != nil {
+    return hostnames, backends, err
+  }
+
   for _, backend := range backendList {
     ok, err := r.client.SIsMember(r.Key("live_backend:%s", app), backend)
     if err != nil {
       return hostnames, backends, err
     }
 
-    if ok > 0 {
-      backends[backend] = true
-    } else {
-      backends[backend] = false
+    ejection, err := r.ejection(app, backend)
+    if err != nil {
+      return hostnames, backends, err
+    }
+
+    health, err := r.BackendHealth(app, backend)
+    if err != nil {
+      return hostnames, backends, err
+    }
+
+    backends[backend] = BackendInfo{
+      Alive:       ok > 0,
+      Weight:      weightOf(weights, backend),
+      Ejection:    ejection,
+      Flapping:    health.Flapping(),
+      CertExpires: health.certExpires(),
     }
   }
 
@@ -339,3 +985,17 @@ func (r *RedisStore) DescribeApplication(app string) ([]string, map[string]bool,
 func (epoint *Endpoint) Addr() string {
   return epoint.addr
 }
+
+func (epoint *Endpoint) App() string {
+  return epoint.app
+}
+
+// StripPrefix is the route prefix to remove from the request path, if any.
+func (epoint *Endpoint) StripPrefix() string {
+  return epoint.strip
+}
+
+// Sticky tells whether the application pins clients to a backend.
+func (epoint *Endpoint) Sticky() bool {
+  return epoint.sticky
+}
@@ -1,8 +1,22 @@
 package knuckles
 
 import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/json"
+  "encoding/pem"
+  "fmt"
   "github.com/fiorix/go-redis/redis"
+  "math/big"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
   "testing"
+  "time"
 )
 
 var namespace = "test:"
@@ -71,19 +85,19 @@ func Test_StoreBackend(t *testing.T) {
 
   r.AddHostname("testapp", "something.com")
 
-  err = r.AddBackend("testapp", "something.com:8080", 10)
+  err = r.AddBackend("testapp", "something.com:8080", 10, 0)
 
   if err != nil {
     t.Fatal(err)
   }
 
-  err = r.AddBackend("testapp", "something.com:8080", 10)
+  err = r.AddBackend("testapp", "something.com:8080", 10, 0)
 
   if err != nil {
     t.Fatal(err)
   }
 
-  bk, err := r.EndpointForHostname("something.com")
+  bk, err := r.EndpointForHostname("something.com", nil)
 
   if err != nil {
     t.Fatal(err)
@@ -93,3 +107,1395 @@ func Test_StoreBackend(t *testing.T) {
     t.Fatal("Invalid backend", bk)
   }
 }
+
+func Test_RedisStoreCache(t *testing.T) {
+  redisClear()
+  r, err := NewRedisStore(namespace, addr)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  r.EnableCache(time.Minute)
+  time.Sleep(300 * time.Millisecond)
+
+  r.AddApplication("testapp")
+  r.AddHostname("testapp", "something.com")
+  r.AddBackend("testapp", "10.0.0.1:8080", 0, 0)
+
+  for i := 0; i < 2; i++ {
+    bk, err := r.EndpointForHostname("something.com", nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if bk.Addr() != "10.0.0.1:8080" {
+      t.Fatal("Invalid backend", bk)
+    }
+  }
+
+  stats := r.CacheStats()
+  if stats.Hits != 2 || stats.Misses != 2 {
+    t.Fatal("Invalid cache stats", stats)
+  }
+
+  r.AddBackend("testapp", "10.0.0.2:8080", 0, 0)
+  r.RemoveBackend("testapp", "10.0.0.1:8080")
+  time.Sleep(100 * time.Millisecond)
+
+  bk, _ := r.EndpointForHostname("something.com", nil)
+  if bk.Addr() != "10.0.0.2:8080" {
+    t.Fatal("Cache not invalidated", bk)
+  }
+
+  // unknown hostnames come from clients and are never kept
+  for i := 0; i < 100; i++ {
+    r.EndpointForHostname(fmt.Sprintf("random%d.com", i), nil)
+  }
+
+  if n := len(r.cache.hosts); n != 1 {
+    t.Fatal("Cached unknown hostnames", n)
+  }
+}
+
+func Test_ResolveCachePaused(t *testing.T) {
+  c := newResolveCache(time.Minute)
+  e := hostEntry{apps: []string{"testapp"}, routes: [][]Route{nil}}
+
+  c.setHost("something.com", e, c.generation())
+  c.pause()
+  if _, ok := c.host("something.com"); ok {
+    t.Fatal("Paused cache kept an entry")
+  }
+
+  c.setHost("something.com", e, c.generation())
+  if _, ok := c.host("something.com"); ok {
+    t.Fatal("Paused cache filled")
+  }
+
+  c.resume()
+  c.setHost("something.com", e, c.generation())
+  if _, ok := c.host("something.com"); !ok {
+    t.Fatal("Resumed cache not filled")
+  }
+}
+
+func Test_ResolveCacheBounded(t *testing.T) {
+  c := newResolveCache(time.Minute)
+  e := hostEntry{apps: []string{"testapp"}, routes: [][]Route{nil}}
+
+  for i := 0; i < maxCachedHosts+100; i++ {
+    c.setHost(fmt.Sprintf("host%d.com", i), e, c.generation())
+  }
+
+  if n := len(c.hosts); n > maxCachedHosts {
+    t.Fatal("Cache grew past its bound", n)
+  }
+
+  c = newResolveCache(time.Millisecond)
+  c.setHost("something.com", e, c.generation())
+  time.Sleep(5 * time.Millisecond)
+
+  if _, ok := c.host("something.com"); ok || len(c.hosts) != 0 {
+    t.Fatal("Expired entry kept", c.hosts)
+  }
+}
+
+// Test_RedisStoreReapLegacy reaps a backend registered before the
+// backend_expiry index existed
+func Test_RedisStoreReapLegacy(t *testing.T) {
+  redisClear()
+  r, err := NewRedisStore(namespace, addr)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  r.AddApplication("testapp")
+  r.AddBackend("testapp", "10.0.0.1:8080", 1, 0)
+
+  c := redis.New(addr)
+  c.ZRem(namespace+"backend_expiry", "testapp\n10.0.0.1:8080")
+  c.Set(namespace+"backend_ttl:testapp:10.0.0.1:8080", strconv.FormatInt(time.Now().Unix()-10, 10))
+
+  n, err := r.ReapBackends()
+  if err != nil || n != 1 {
+    t.Fatal("Legacy backend not reaped", n, err)
+  }
+
+  backends, _ := r.BackendsForApp("testapp")
+  if len(backends) != 0 {
+    t.Fatal("Legacy backend left", backends)
+  }
+}
+
+// Test_RedisStoreConsistency races adds and removes over a few
+// applications, then checks no key is left behind by a removal
+func Test_RedisStoreConsistency(t *testing.T) {
+  redisClear()
+  r, err := NewRedisStore(namespace, addr)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  apps := []string{"app1", "app2", "app3"}
+  var wg sync.WaitGroup
+
+  for i := 0; i < 8; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+
+      for j := 0; j < 300; j++ {
+        app := apps[(i+j)%len(apps)]
+        hostname := fmt.Sprintf("host%d.com", j%4)
+
+        switch (i + 3*j) % 8 {
+        case 0:
+          r.AddApplication(app)
+        case 1:
+          r.AddHostname(app, hostname)
+        case 2:
+          r.AddBackend(app, fmt.Sprintf("10.0.0.%d:8080", j%4), 60, 0)
+        case 3:
+          r.AddRoute(app, hostname, "/"+app, false)
+        case 4:
+          r.RemoveHostname(app, hostname)
+        case 5:
+          r.EjectBackend(app, fmt.Sprintf("10.0.0.%d:8080", j%4), "test", time.Minute)
+        case 6:
+          r.SetErrorPage(app, PageNoBackend, "<h1>{{.Status}}</h1>")
+        case 7:
+          r.RemoveApplication(app)
+        }
+      }
+    }(i)
+  }
+
+  wg.Wait()
+
+  checkKeyspace(t, redis.New(addr))
+}
+
+// checkKeyspace fails on keys of missing applications, hostnames
+// resolving to an application that doesn't list them and backend keys of
+// missing backends
+func checkKeyspace(t *testing.T, c *redis.Client) {
+  members := func(key string) map[string]bool {
+    list, err := c.SMembers(namespace + key)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    set := make(map[string]bool)
+    for _, m := range list {
+      set[m] = true
+    }
+    return set
+  }
+
+  apps := members("apps")
+
+  keys, err := c.Keys(namespace + "*")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  for _, key := range keys {
+    parts := strings.SplitN(strings.TrimPrefix(key, namespace), ":", 2)
+    if len(parts) != 2 {
+      continue
+    }
+    kind, name := parts[0], parts[1]
+
+    switch kind {
+    case "resolve":
+      app, _ := c.Get(key)
+      if !apps[app] || !members("hostname:" + app)[name] {
+        t.Fatal("Dangling hostname", name, app)
+      }
+    case "hostname", "backend", "live_backend", "backend_weight", "backend_ttl_secs", "ejection", "health", "settings", "app_routes", "error_pages":
+      if !apps[name] {
+        t.Fatal("Key of missing application", key)
+      }
+    case "backend_ttl":
+      be := strings.SplitN(name, ":", 2)
+      if !members("backend:" + be[0])[be[1]] {
+        t.Fatal("Ttl of missing backend", key)
+      }
+    case "routes":
+      raw, _ := c.Get(key)
+      var routes []Route
+      json.Unmarshal([]byte(raw), &routes)
+      for _, rt := range routes {
+        if !apps[rt.App] || !members("app_routes:" + rt.App)[name+"\n"+rt.Prefix] {
+          t.Fatal("Dangling route", key, rt)
+        }
+      }
+    }
+  }
+
+  for app, _ := range apps {
+    for h, _ := range members("hostname:" + app) {
+      owner, _ := c.Get(namespace + "resolve:" + h)
+      if owner != app {
+        t.Fatal("Hostname does not resolve to its application", app, h, owner)
+      }
+    }
+
+    backends := members("backend:" + app)
+    for be, _ := range members("live_backend:" + app) {
+      if !backends[be] {
+        t.Fatal("Live backend not registered", app, be)
+      }
+    }
+  }
+
+  due, err := c.ZRangeByScore(namespace+"backend_expiry", "-inf", "+inf", false, false, 0, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  for _, member := range due {
+    be := strings.SplitN(member, "\n", 2)
+    if !members("backend:" + be[0])[be[1]] {
+      t.Fatal("Expiry of missing backend", member)
+    }
+  }
+}
+
+// conformance checks run against every Store implementation
+var conformance = []func(t *testing.T, s Store){
+  conformApplications,
+  conformHostnames,
+  conformBackends,
+  conformLiveness,
+  conformTTL,
+  conformHeartbeat,
+  conformRemoveApplication,
+  conformStrategy,
+  conformAffinity,
+  conformExclude,
+  conformEjection,
+  conformHealthCheck,
+  conformErrorPages,
+  conformRiseFall,
+  conformWeights,
+  conformWildcards,
+  conformRoutes,
+  conformCertificates,
+  conformLeases,
+  conformGroups,
+  conformEvents,
+}
+
+func runConformance(t *testing.T, newStore func() Store) {
+  for _, check := range conformance {
+    check(t, newStore())
+  }
+}
+
+func Test_RedisStoreConformance(t *testing.T) {
+  runConformance(t, func() Store {
+    redisClear()
+    r, err := NewRedisStore(namespace, addr)
+    if err != nil {
+      t.Fatal(err)
+    }
+    return r
+  })
+}
+
+func Test_MemoryStoreConformance(t *testing.T) {
+  runConformance(t, func() Store {
+    return NewMemoryStore()
+  })
+}
+
+func conformApplications(t *testing.T, s Store) {
+  err := s.AddApplication("testapp")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  err = s.AddApplication("testapp")
+  if err != ErrAppAlreadyExists {
+    t.Fatal("Duplicated application", err)
+  }
+
+  apps, err := s.ListApplications()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if len(apps) != 1 || apps[0] != "testapp" {
+    t.Fatal("Invalid application list", apps)
+  }
+
+  _, _, err = s.DescribeApplication("missing")
+  if err != ErrNoApp {
+    t.Fatal("Described missing application", err)
+  }
+}
+
+func conformHostnames(t *testing.T, s Store) {
+  err := s.AddHostname("testapp", "something.com")
+  if err != ErrNoApp {
+    t.Fatal("Hostname added to missing application", err)
+  }
+
+  s.AddApplication("testapp")
+
+  err = s.AddHostname("testapp", "something.com")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  err = s.AddHostname("testapp", "something.com")
+  if err != ErrHostnameAlreadyExists {
+    t.Fatal("Duplicated hostname", err)
+  }
+
+  _, err = s.EndpointForHostname("something.com", nil)
+  if err != ErrNoBackend {
+    t.Fatal("Endpoint without backends", err)
+  }
+
+  _, err = s.EndpointForHostname("nothing.com", nil)
+  if err != ErrNoHostname {
+    t.Fatal("Endpoint for unknown hostname", err)
+  }
+
+  err = s.RemoveHostname("testapp", "something.com")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  hostnames, err := s.HostnamesForApp("testapp")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if len(hostnames) != 0 {
+    t.Fatal("Hostname not removed", hostnames)
+  }
+
+  _, err = s.EndpointForHostname("something.com", nil)
+  if err != ErrNoHostname {
+    t.Fatal("Removed hostname still resolves", err)
+  }
+}
+
+func conformBackends(t *testing.T, s Store) {
+  s.AddApplication("testapp")
+  s.AddHostname("testapp", "something.com")
+
+  err := s.AddBackend("testapp", "10.0.0.1:8080", 0, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  err = s.AddBackend("testapp", "10.0.0.2:8080", 0, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  backends, err := s.BackendsForApp("testapp")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if len(backends) != 2 {
+    t.Fatal("Invalid backend list", backends)
+  }
+
+  seen := make(map[string]bool)
+  for i := 0; i < 100; i++ {
+    bk, err := s.EndpointForHostname("something.com", nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+    seen[bk.Addr()] = true
+  }
+
+  if len(seen) != 2 {
+    t.Fatal("Not all backends selected", seen)
+  }
+
+  err = s.RemoveBackend("testapp", "10.0.0.1:8080")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  bk, err := s.EndpointForHostname("something.com", nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if bk.Addr() != "10.0.0.2:8080" {
+    t.Fatal("Removed backend selected", bk)
+  }
+}
+
+func conformLiveness(t *testing.T, s Store) {
+  s.AddApplication("testapp")
+  s.AddHostname("testapp", "something.com")
+  s.AddBackend("testapp", "10.0.0.1:8080", 0, 0)
+
+  err := s.DisableBackend("testapp", "10.0.0.1:8080", "test")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  _, err = s.EndpointForHostname("something.com", nil)
+  if err != ErrNoBackend {
+    t.Fatal("Dead backend selected", err)
+  }
+
+  hostnames, backends, err := s.DescribeApplication("testapp")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if len(hostnames) != 1 || hostnames[0] != "something.com" {
+    t.Fatal("Invalid hostnames", hostnames)
+  }
+
+  if info, ok := backends["10.0.0.1:8080"]; !ok || info.Alive {
+    t.Fatal("Invalid backend state", backends)
+  }
+
+  err = s.EnableBackend("testapp", "10.0.0.1:8080", "test")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  _, backends, _ = s.DescribeApplication("testapp")
+  if !backends["10.0.0.1:8080"].Alive {
+    t.Fatal("Backend not enabled", backends)
+  }
+
+  s.AddBackend("testapp", "10.0.0.2:8080", 0, 0)
+  s.DisableBackend("testapp", "10.0.0.2:8080", "test")
+
+  counts, err := s.CountBackends()
+  if err != nil || counts["testapp"] != (BackendCount{Total: 2, Live: 1}) {
+    t.Fatal("Invalid backend counts", counts, err)
+  }
+
+  err = s.EnableBackend("testapp", "10.0.0.9:8080", "test")
+  if err != ErrNoBackend {
+    t.Fatal("Enabled unknown backend", err)
+  }
+}
+
+func conformTTL(t *testing.T, s Store) {
+  ch := make(chan Event, 64)
+  s.Subscribe(ch)
+  defer s.Unsubscribe(ch)
+
+  s.AddApplication("testapp")
+  s.AddHostname("testapp", "something.com")
+  s.AddBackend("testapp", "10.0.0.1:8080", 1, 0)
+  s.AddBackend("testapp", "10.0.0.2:8080", 0, 0)
+  s.AddBackend("testapp", "10.0.0.3:8080", 1, 0)
+
+  time.Sleep(2100 * time.Millisecond)
+
+  for i := 0; i < 8; i++ {
+    bk, err := s.EndpointForHostname("something.com", nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if bk.Addr() != "10.0.0.2:8080" {
+      t.Fatal("Expired backend selected", bk)
+    }
+  }
+
+  err := s.EnableBackend("testapp", "10.0.0.1:8080", "test")
+  if err != ErrNoBackend {
+    t.Fatal("Expired backend enabled", err)
+  }
+
+  ev := expectEvent(t, ch, EventBackendRemoved, "10.0.0.1:8080")
+  if ev.Reason != "ttl expired" || ev.Old != StateLive {
+    t.Fatal("Unexpected expiry event", ev)
+  }
+
+  n, err := s.ReapBackends()
+  if err != nil || n != 1 {
+    t.Fatal("Expected one reaped backend", n, err)
+  }
+
+  ev = expectEvent(t, ch, EventBackendRemoved, "10.0.0.3:8080")
+  if ev.Reason != "ttl expired" {
+    t.Fatal("Unexpected reaper event", ev)
+  }
+
+  n, _ = s.ReapBackends()
+  if n != 0 {
+    t.Fatal("Backend reaped twice", n)
+  }
+
+  err = s.EnableBackend("testapp", "10.0.0.2:8080", "test")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  backends, _ := s.BackendsForApp("testapp")
+  if len(backends) != 1 || backends[0] != "10.0.0.2:8080" {
+    t.Fatal("Expired backend not removed", backends)
+  }
+}
+
+func conformHeartbeat(t *testing.T, s Store) {
+  s.AddApplication("testapp")
+  s.AddBackend("testapp", "10.0.0.1:8080", 2, 0)
+  s.AddBackend("testapp", "10.0.0.2:8080", 0, 0)
+
+  err := s.RenewBackend("testapp", "10.0.0.9:8080", 0)
+  if err != ErrNoBackend {
+    t.Fatal("Expected ErrNoBackend for an unknown backend", err)
+  }
+
+  err = s.RenewBackend("testapp", "10.0.0.2:8080", 0)
+  if err != ErrNoTTL {
+    t.Fatal("Expected ErrNoTTL for a backend without ttl", err)
+  }
+
+  s.DisableBackend("testapp", "10.0.0.1:8080", "test")
+
+  for i := 0; i < 3; i++ {
+    time.Sleep(1100 * time.Millisecond)
+    err = s.RenewBackend("testapp", "10.0.0.1:8080", 0)
+    if err != nil {
+      t.Fatal("Heartbeat failed", err)
+    }
+  }
+
+  _, backends, _ := s.DescribeApplication("testapp")
+  info, ok := backends["10.0.0.1:8080"]
+  if !ok || info.Alive {
+    t.Fatal("Heartbeat changed more than the ttl", backends)
+  }
+}
+
+func conformRemoveApplication(t *testing.T, s Store) {
+  s.AddApplication("testapp")
+  s.AddHostname("testapp", "something.com")
+  s.AddBackend("testapp", "10.0.0.1:8080", 0, 0)
+
+  err := s.RemoveApplication("testapp")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  err = s.RemoveApplication("testapp")
+  if err != ErrNoApp {
+    t.Fatal("Removed missing application", err)
+  }
+
+  _, err = s.EndpointForHostname("something.com", nil)
+  if err != ErrNoHostname {
+    t.Fatal("Hostname of removed application resolves", err)
+  }
+
+  apps, _ := s.ListApplications()
+  if len(apps) != 0 {
+    t.Fatal("Application not removed", apps)
+  }
+
+  // a hostname another application took over stays with it
+  s.AddApplication("app1")
+  s.AddApplication("app2")
+  s.AddHostname("app1", "shared.com")
+  s.AddBackend("app2", "10.0.0.2:8080", 0, 0)
+  takeOver(s, "app2", "shared.com")
+
+  s.RemoveApplication("app1")
+
+  bk, err := s.EndpointForHostname("shared.com", nil)
+  if err != nil || bk.App() != "app2" {
+    t.Fatal("Hostname of another application removed", bk, err)
+  }
+}
+
+// takeOver points hostname at app while the application holding it still
+// lists it, as older versions could leave it
+func takeOver(s Store, app, hostname string) {
+  switch s := s.(type) {
+  case *MemoryStore:
+    s.mu.Lock()
+    s.resolve[hostname] = app
+    s.apps[app].hostnames[hostname] = true
+    s.mu.Unlock()
+  case *RedisStore:
+    s.client.Set(s.Key("resolve:%s", hostname), app)
+    s.client.SAdd(s.Key("hostname:%s", app), hostname)
+  }
+}
+
+func conformStrategy(t *testing.T, s Store) {
+  err := s.SetStrategy("testapp", Strategy{Name: StrategyRoundRobin})
+  if err != ErrNoApp {
+    t.Fatal("Strategy set on missing application", err)
+  }
+
+  s.AddApplication("testapp")
+  s.AddHostname("testapp", "something.com")
+  s.AddBackend("testapp", "10.0.0.1:8080", 0, 0)
+  s.AddBackend("testapp", "10.0.0.2:8080", 0, 0)
+
+  strategy, err := s.StrategyForApp("testapp")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if strategy.Name != StrategyRandom {
+    t.Fatal("Invalid default strategy", strategy)
+  }
+
+  err = s.SetStrategy("testapp", Strategy{Name: "fastest"})
+  if err != ErrInvalidStrategy {
+    t.Fatal("Invalid strategy accepted", err)
+  }
+
+  err = s.SetStrategy("testapp", Strategy{Name: StrategyHashHeader})
+  if err != ErrInvalidStrategy {
+    t.Fatal("Hash strategy without key accepted", err)
+  }
+
+  err = s.SetStrategy("testapp", Strategy{Name: StrategyRoundRobin})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  first, _ := s.EndpointForHostname("something.com", nil)
+  second, _ := s.EndpointForHostname("something.com", nil)
+  if first.Addr() == second.Addr() {
+    t.Fatal("Round robin picked the same backend twice", first)
+  }
+
+  err = s.SetStrategy("testapp", Strategy{Name: StrategyHashHeader, Key: "X-User"})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  strategy, _ = s.StrategyForApp("testapp")
+  if strategy.Name != StrategyHashHeader || strategy.Key != "X-User" {
+    t.Fatal("Strategy not stored", strategy)
+  }
+
+  r, _ := http.NewRequest("GET", "http://something.com/", nil)
+  r.Header.Set("X-User", "42")
+  ctx := &RequestContext{Request: r}
+
+  pinned, _ := s.EndpointForHostname("something.com", ctx)
+  for i := 0; i < 20; i++ {
+    bk, _ := s.EndpointForHostname("something.com", ctx)
+    if bk.Addr() != pinned.Addr() {
+      t.Fatal("Hash strategy moved the same key", pinned, bk)
+    }
+  }
+}
+
+func conformAffinity(t *testing.T, s Store) {
+  s.AddApplication("testapp")
+  s.AddHostname("testapp", "something.com")
+  s.AddBackend("testapp", "10.0.0.1:8080", 0, 0)
+  s.AddBackend("testapp", "10.0.0.2:8080", 0, 0)
+  s.SetStrategy("testapp", Strategy{Name: StrategyRoundRobin})
+
+  ctx := &RequestContext{PinnedApp: "testapp", Pinned: "10.0.0.2:8080"}
+
+  bk, _ := s.EndpointForHostname("something.com", ctx)
+  if bk.Sticky() {
+    t.Fatal("Affinity enabled by default")
+  }
+
+  err := s.SetAffinity("testapp", true)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  enabled, _ := s.AffinityForApp("testapp")
+  if !enabled {
+    t.Fatal("Affinity not stored")
+  }
+
+  for i := 0; i < 4; i++ {
+    bk, err = s.EndpointForHostname("something.com", ctx)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if !bk.Sticky() || bk.App() != "testapp" || bk.Addr() != "10.0.0.2:8080" {
+      t.Fatal("Pinned backend not selected", bk)
+    }
+  }
+
+  s.DisableBackend("testapp", "10.0.0.2:8080", "test")
+
+  bk, _ = s.EndpointForHostname("something.com", ctx)
+  if bk.Addr() != "10.0.0.1:8080" {
+    t.Fatal("Dead pinned backend selected", bk)
+  }
+
+  ctx.PinnedApp = "otherapp"
+  s.EnableBackend("testapp", "10.0.0.2:8080", "test")
+  seen := make(map[string]bool)
+  for i := 0; i < 4; i++ {
+    bk, _ = s.EndpointForHostname("something.com", ctx)
+    seen[bk.Addr()] = true
+  }
+
+  if len(seen) != 2 {
+    t.Fatal("Pin from another application honoured", seen)
+  }
+}
+
+func conformEjection(t *testing.T, s Store) {
+  s.AddApplication("testapp")
+  s.AddHostname("testapp", "something.com")
+  s.AddBackend("testapp", "10.0.0.1:8080", 0, 0)
+  s.EnableBackend("testapp", "10.0.0.1:8080", "test")
+
+  err := s.EjectBackend("testapp", "10.0.0.1:8080", "5 consecutive failures", time.Second)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  _, err = s.EndpointForHostname("something.com", nil)
+  if err != ErrNoBackend {
+    t.Fatal("Ejected backend still selected", err)
+  }
+
+  err = s.EnableBackend("testapp", "10.0.0.1:8080", "test")
+  if err != ErrBackendEjected {
+    t.Fatal("Ejected backend enabled during cooldown", err)
+  }
+
+  _, backends, _ := s.DescribeApplication("testapp")
+  info := backends["10.0.0.1:8080"]
+  if info.Alive || info.Ejection == nil || info.Ejection.Reason != "5 consecutive failures" {
+    t.Fatal("Ejection not recorded", info)
+  }
+
+  // registering again during the cooldown keeps the backend out
+  err = s.AddBackend("testapp", "10.0.0.1:8080", 0, 0)
+  if err != nil {
+    t.Fatal("Re-registering an ejected backend failed", err)
+  }
+
+  _, backends, _ = s.DescribeApplication("testapp")
+  if backends["10.0.0.1:8080"].Alive {
+    t.Fatal("Ejected backend enabled by registration")
+  }
+
+  time.Sleep(1100 * time.Millisecond)
+
+  err = s.EnableBackend("testapp", "10.0.0.1:8080", "test")
+  if err != nil {
+    t.Fatal("Backend not enabled after cooldown", err)
+  }
+
+  bk, _ := s.EndpointForHostname("something.com", nil)
+  if bk.Addr() != "10.0.0.1:8080" {
+    t.Fatal("Restored backend not selected", bk)
+  }
+}
+
+func conformHealthCheck(t *testing.T, s Store) {
+  s.AddApplication("testapp")
+
+  check, err := s.HealthCheckForApp("testapp")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if check.Path != "/" || check.Method != "GET" || !check.expects(200) || !check.expects(302) || check.expects(503) {
+    t.Fatal("Unexpected default health check", check)
+  }
+
+  err = s.SetHealthCheck("testapp", HealthCheck{Path: "healthz", Method: "GET", Timeout: time.Second})
+  if err != ErrInvalidHealthCheck {
+    t.Fatal("Expected ErrInvalidHealthCheck for a relative path", err)
+  }
+
+  err = s.SetHealthCheck("testapp", HealthCheck{Path: "/healthz", Method: "GET", Status: "299-200", Timeout: time.Second})
+  if err != ErrInvalidHealthCheck {
+    t.Fatal("Expected ErrInvalidHealthCheck for a bad status", err)
+  }
+
+  err = s.SetHealthCheck("testapp", HealthCheck{
+    Path:    "/healthz",
+    Method:  "HEAD",
+    Status:  "200-299, 304",
+    Headers: map[string]string{"Host": "something.com"},
+    Timeout: time.Second,
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  check, _ = s.HealthCheckForApp("testapp")
+  if check.Path != "/healthz" || check.Method != "HEAD" || check.Headers["Host"] != "something.com" {
+    t.Fatal("Health check not stored", check)
+  }
+
+  if !check.expects(204) || !check.expects(304) || check.expects(503) {
+    t.Fatal("Status ranges not applied", check.Status)
+  }
+}
+
+func conformErrorPages(t *testing.T, s Store) {
+  s.AddApplication("testapp")
+  s.AddHostname("testapp", "something.com")
+
+  body, err := s.ErrorPageForApp("testapp", PageNoBackend)
+  if err != nil || body != "" {
+    t.Fatal("Unexpected error page", body, err)
+  }
+
+  err = s.SetErrorPage("testapp", PageNoBackend, "<h1>{{.Status}} {{.Hostname}}</h1>")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  body, _ = s.ErrorPageForApp("testapp", PageNoBackend)
+  if body != "<h1>{{.Status}} {{.Hostname}}</h1>" {
+    t.Fatal("Error page not saved", body)
+  }
+
+  err = s.SetErrorPage("testapp", "teapot", "<h1>418</h1>")
+  if err != ErrInvalidErrorPage {
+    t.Fatal("Accepted unknown page", err)
+  }
+
+  err = s.SetErrorPage("testapp", PageNoHostname, "<h1>404</h1>")
+  if err != ErrInvalidErrorPage {
+    t.Fatal("Accepted page without application", err)
+  }
+
+  err = s.SetErrorPage("testapp", PageBackendError, "{{.Status")
+  if err != ErrInvalidErrorPage {
+    t.Fatal("Accepted broken template", err)
+  }
+
+  err = s.SetErrorPage("otherapp", PageNoBackend, "<h1>503</h1>")
+  if err != ErrNoApp {
+    t.Fatal("Error page for missing application", err)
+  }
+
+  // the application is known even without backends, to pick its page
+  ep, err := s.EndpointForHostname("something.com", nil)
+  if err != ErrNoBackend || ep.App() != "testapp" {
+    t.Fatal("Missing application of failed endpoint", ep.App(), err)
+  }
+
+  err = s.RemoveErrorPage("testapp", PageNoBackend)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  err = s.RemoveErrorPage("testapp", PageNoBackend)
+  if err != ErrNoErrorPage {
+    t.Fatal("Removed missing error page", err)
+  }
+}
+
+func conformRiseFall(t *testing.T, s Store) {
+  s.AddApplication("testapp")
+  s.AddBackend("testapp", "10.0.0.1:8080", 0, 0)
+
+  p, _ := NewPinger(PingerConfig{Store: s, Rise: 2, Fall: 3, FlapThreshold: 3, FlapWindow: time.Minute})
+
+  alive := func() bool {
+    _, backends, _ := s.DescribeApplication("testapp")
+    return backends["10.0.0.1:8080"].Alive
+  }
+
+  probe := func(result bool) {
+    var probeErr error
+    if !result {
+      probeErr = ErrDeadBackend
+    }
+
+    err := p.judge("testapp", "10.0.0.1:8080", alive(), probeErr, time.Time{})
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  probe(false)
+  probe(false)
+  if !alive() {
+    t.Fatal("Backend disabled before fall probes")
+  }
+
+  probe(false)
+  if alive() {
+    t.Fatal("Backend still enabled after fall probes")
+  }
+
+  probe(true)
+  if alive() {
+    t.Fatal("Backend enabled before rise probes")
+  }
+
+  probe(true)
+  if !alive() {
+    t.Fatal("Backend not enabled after rise probes")
+  }
+
+  state, _ := s.BackendHealth("testapp", "10.0.0.1:8080")
+  if state.Successes != 2 || state.Failures != 0 || len(state.Transitions) != 2 {
+    t.Fatal("Health state not stored", state)
+  }
+
+  for i := 0; i < 3; i++ {
+    probe(false)
+  }
+
+  _, backends, _ := s.DescribeApplication("testapp")
+  if backends["10.0.0.1:8080"].Alive || !backends["10.0.0.1:8080"].Flapping {
+    t.Fatal("Flapping backend not reported", backends)
+  }
+
+  probe(true)
+  probe(true)
+  if alive() {
+    t.Fatal("Flapping backend enabled")
+  }
+}
+
+func conformLeases(t *testing.T, s Store) {
+  ok, err := s.AcquireLease("pinger:testapp", "p1", time.Second)
+  if err != nil || !ok {
+    t.Fatal("Lease not acquired", err)
+  }
+
+  ok, _ = s.AcquireLease("pinger:testapp", "p2", time.Second)
+  if ok {
+    t.Fatal("Lease acquired while held")
+  }
+
+  ok, _ = s.AcquireLease("pinger:testapp", "p1", time.Second)
+  if !ok {
+    t.Fatal("Lease not renewed by its owner")
+  }
+
+  s.ReleaseLease("pinger:testapp", "p2")
+  ok, _ = s.AcquireLease("pinger:testapp", "p2", time.Second)
+  if ok {
+    t.Fatal("Lease released by another owner")
+  }
+
+  time.Sleep(1100 * time.Millisecond)
+
+  ok, _ = s.AcquireLease("pinger:testapp", "p2", time.Second)
+  if !ok {
+    t.Fatal("Lease did not expire")
+  }
+
+  s.ReleaseLease("pinger:testapp", "p2")
+  ok, _ = s.AcquireLease("pinger:testapp", "p1", time.Second)
+  if !ok {
+    t.Fatal("Lease not released")
+  }
+}
+
+func conformGroups(t *testing.T, s Store) {
+  s.JoinGroup("pingers", "p1", time.Minute)
+  s.JoinGroup("pingers", "p2", 500*time.Millisecond)
+  s.JoinGroup("others", "p3", time.Minute)
+
+  members, err := s.GroupMembers("pingers")
+  if err != nil || strings.Join(members, ",") != "p1,p2" {
+    t.Fatal("Unexpected members", members, err)
+  }
+
+  time.Sleep(600 * time.Millisecond)
+
+  members, _ = s.GroupMembers("pingers")
+  if strings.Join(members, ",") != "p1" {
+    t.Fatal("Member did not expire", members)
+  }
+
+  s.LeaveGroup("pingers", "p1")
+  members, _ = s.GroupMembers("pingers")
+  if len(members) != 0 {
+    t.Fatal("Member did not leave", members)
+  }
+}
+
+func conformExclude(t *testing.T, s Store) {
+  s.AddApplication("testapp")
+  s.AddHostname("testapp", "something.com")
+  s.AddBackend("testapp", "10.0.0.1:8080", 0, 0)
+  s.AddBackend("testapp", "10.0.0.2:8080", 0, 0)
+  s.SetAffinity("testapp", true)
+
+  ctx := &RequestContext{
+    PinnedApp: "testapp",
+    Pinned:    "10.0.0.1:8080",
+    Exclude:   map[string]bool{"10.0.0.1:8080": true},
+  }
+
+  for i := 0; i < 4; i++ {
+    bk, err := s.EndpointForHostname("something.com", ctx)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if bk.Addr() != "10.0.0.2:8080" {
+      t.Fatal("Excluded backend selected", bk)
+    }
+  }
+
+  ctx.Exclude["10.0.0.2:8080"] = true
+
+  _, err := s.EndpointForHostname("something.com", ctx)
+  if err != ErrNoBackend {
+    t.Fatal("Expected ErrNoBackend with every backend excluded", err)
+  }
+}
+
+func conformWeights(t *testing.T, s Store) {
+  s.AddApplication("testapp")
+  s.AddHostname("testapp", "something.com")
+  s.AddBackend("testapp", "10.0.0.1:8080", 0, 3)
+  s.AddBackend("testapp", "10.0.0.2:8080", 0, 0)
+
+  _, backends, err := s.DescribeApplication("testapp")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if backends["10.0.0.1:8080"].Weight != 3 || backends["10.0.0.2:8080"].Weight != DefaultWeight {
+    t.Fatal("Invalid weights", backends)
+  }
+
+  err = s.SetBackendWeight("testapp", "10.0.0.2:8080", 0)
+  if err != ErrInvalidWeight {
+    t.Fatal("Invalid weight accepted", err)
+  }
+
+  err = s.SetBackendWeight("testapp", "10.0.0.9:8080", 2)
+  if err != ErrNoBackend {
+    t.Fatal("Weight set on unknown backend", err)
+  }
+
+  s.SetStrategy("testapp", Strategy{Name: StrategyRoundRobin})
+
+  counts := make(map[string]int)
+  for i := 0; i < 8; i++ {
+    bk, _ := s.EndpointForHostname("something.com", nil)
+    counts[bk.Addr()]++
+  }
+
+  if counts["10.0.0.1:8080"] != 6 || counts["10.0.0.2:8080"] != 2 {
+    t.Fatal("Round robin ignored weights", counts)
+  }
+
+  err = s.SetBackendWeight("testapp", "10.0.0.2:8080", 3)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  _, backends, _ = s.DescribeApplication("testapp")
+  if backends["10.0.0.2:8080"].Weight != 3 {
+    t.Fatal("Weight not updated", backends)
+  }
+
+  // registering again keeps the weight and the state unless told otherwise
+  s.DisableBackend("testapp", "10.0.0.2:8080", "test")
+  s.AddBackend("testapp", "10.0.0.2:8080", 0, 0)
+  s.AddBackend("testapp", "10.0.0.1:8080", 0, 5)
+
+  _, backends, _ = s.DescribeApplication("testapp")
+  if backends["10.0.0.2:8080"].Weight != 3 || backends["10.0.0.2:8080"].Alive {
+    t.Fatal("Backend reset when registered again", backends)
+  }
+
+  if backends["10.0.0.1:8080"].Weight != 5 {
+    t.Fatal("Weight not updated", backends)
+  }
+}
+
+func conformWildcards(t *testing.T, s Store) {
+  s.AddApplication("exact")
+  s.AddApplication("wide")
+  s.AddApplication("narrow")
+  s.AddApplication("default")
+  s.AddBackend("exact", "10.0.0.1:8080", 0, 0)
+  s.AddBackend("wide", "10.0.0.2:8080", 0, 0)
+  s.AddBackend("narrow", "10.0.0.3:8080", 0, 0)
+  s.AddBackend("default", "10.0.0.4:8080", 0, 0)
+
+  for _, h := range []string{"*bad.com", "a.*.com", "*.", ""} {
+    err := s.AddHostname("wide", h)
+    if err != ErrInvalidHostname {
+      t.Fatal("Invalid hostname accepted", h, err)
+    }
+  }
+
+  s.AddHostname("exact", "www.customer.example.com")
+  s.AddHostname("wide", "*.example.com")
+  s.AddHostname("narrow", "*.customer.example.com")
+
+  _, err := s.EndpointForHostname("other.org", nil)
+  if err != ErrNoHostname {
+    t.Fatal("Resolved without catch-all", err)
+  }
+
+  err = s.AddHostname("default", CatchAll)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  expected := map[string]string{
+    "www.customer.example.com": "10.0.0.1:8080",
+    "api.customer.example.com": "10.0.0.3:8080",
+    "a.b.customer.example.com": "10.0.0.3:8080",
+    "shop.example.com":         "10.0.0.2:8080",
+    "customer.example.com":     "10.0.0.2:8080",
+    "example.com":              "10.0.0.4:8080",
+    "other.org":                "10.0.0.4:8080",
+  }
+
+  for host, backend := range expected {
+    bk, err := s.EndpointForHostname(host, nil)
+    if err != nil {
+      t.Fatal(host, err)
+    }
+    if bk.Addr() != backend {
+      t.Fatal("Invalid resolution for", host, bk)
+    }
+  }
+}
+
+func conformRoutes(t *testing.T, s Store) {
+  s.AddApplication("web")
+  s.AddApplication("apiv2")
+  s.AddBackend("web", "10.0.0.1:8080", 0, 0)
+  s.AddBackend("apiv2", "10.0.0.2:8080", 0, 0)
+  s.AddHostname("web", "api.example.com")
+
+  err := s.AddRoute("apiv2", "api.example.com", "v2", false)
+  if err != ErrInvalidPrefix {
+    t.Fatal("Relative prefix accepted", err)
+  }
+
+  err = s.AddRoute("apiv2", "api.example.com", "/v2", true)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  err = s.AddRoute("web", "api.example.com", "/v2", false)
+  if err != ErrRouteAlreadyExists {
+    t.Fatal("Duplicated route", err)
+  }
+
+  s.AddRoute("web", "api.example.com", "/v2/legacy", false)
+
+  expected := map[string]string{
+    "/":               "10.0.0.1:8080",
+    "/v2":             "10.0.0.2:8080",
+    "/v2/users":       "10.0.0.2:8080",
+    "/v2beta":         "10.0.0.1:8080",
+    "/v2/legacy/list": "10.0.0.1:8080",
+  }
+
+  for path, backend := range expected {
+    r, _ := http.NewRequest("GET", "http://api.example.com"+path, nil)
+    bk, err := s.EndpointForHostname("api.example.com", &RequestContext{Request: r})
+    if err != nil {
+      t.Fatal(path, err)
+    }
+    if bk.Addr() != backend {
+      t.Fatal("Invalid route for", path, bk)
+    }
+    if backend == "10.0.0.2:8080" && bk.StripPrefix() != "/v2" {
+      t.Fatal("Prefix not stripped for", path, bk)
+    }
+  }
+
+  routes, err := s.RoutesForApp("apiv2")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if len(routes) != 1 || routes[0].Prefix != "/v2" || !routes[0].Strip {
+    t.Fatal("Invalid routes", routes)
+  }
+
+  err = s.RemoveRoute("web", "api.example.com", "/v2")
+  if err != ErrNoRoute {
+    t.Fatal("Removed route of another application", err)
+  }
+
+  s.RemoveApplication("apiv2")
+
+  r, _ := http.NewRequest("GET", "http://api.example.com/v2/users", nil)
+  bk, _ := s.EndpointForHostname("api.example.com", &RequestContext{Request: r})
+  if bk.Addr() != "10.0.0.1:8080" {
+    t.Fatal("Route of removed application used", bk)
+  }
+
+  routes, _ = s.RoutesForApp("web")
+  if len(routes) != 1 {
+    t.Fatal("Routes of other application removed", routes)
+  }
+}
+
+func testCertificate(t *testing.T, hostname string) (string, string) {
+  priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  tmpl := x509.Certificate{
+    SerialNumber: big.NewInt(1),
+    Subject:      pkix.Name{CommonName: hostname},
+    DNSNames:     []string{hostname},
+    NotBefore:    time.Now(),
+    NotAfter:     time.Now().Add(time.Hour),
+  }
+
+  der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  keyDer, err := x509.MarshalECPrivateKey(priv)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+  key := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+  return string(cert), string(key)
+}
+
+func conformCertificates(t *testing.T, s Store) {
+  exactCert, exactKey := testCertificate(t, "www.example.com")
+  wildCert, wildKey := testCertificate(t, "*.example.com")
+
+  err := s.SetCertificate("www.example.com", exactCert, wildKey)
+  if err != ErrInvalidCertificate {
+    t.Fatal("Mismatched key accepted", err)
+  }
+
+  err = s.SetCertificate("www.example.com", exactCert, exactKey)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  err = s.SetCertificate("*.example.com", wildCert, wildKey)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  cert, _, err := s.CertificateForHostname("www.example.com")
+  if err != nil || cert != exactCert {
+    t.Fatal("Exact certificate not selected", err)
+  }
+
+  cert, _, err = s.CertificateForHostname("shop.example.com")
+  if err != nil || cert != wildCert {
+    t.Fatal("Wildcard certificate not selected", err)
+  }
+
+  _, _, err = s.CertificateForHostname("other.org")
+  if err != ErrNoCertificate {
+    t.Fatal("Certificate for unknown hostname", err)
+  }
+
+  err = s.RemoveCertificate("www.example.com")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  cert, _, _ = s.CertificateForHostname("www.example.com")
+  if cert != wildCert {
+    t.Fatal("Removed certificate selected")
+  }
+
+  err = s.RemoveCertificate("www.example.com")
+  if err != ErrNoCertificate {
+    t.Fatal("Removed missing certificate", err)
+  }
+}
+
+func expectEvent(t *testing.T, ch chan Event, typ, backend string) Event {
+  timeout := time.After(time.Second)
+  for {
+    select {
+    case ev := <-ch:
+      if ev.Type == typ && ev.Backend == backend {
+        return ev
+      }
+    case <-timeout:
+      t.Fatal("Missing event", typ, backend)
+    }
+  }
+}
+
+func conformEvents(t *testing.T, s Store) {
+  ch := make(chan Event, 64)
+  s.Subscribe(ch)
+  defer s.Unsubscribe(ch)
+
+  // give a remote subscription time to settle
+  time.Sleep(100 * time.Millisecond)
+
+  s.AddApplication("testapp")
+  s.AddBackend("testapp", "10.0.0.1:8080", 0, 0)
+  s.AddBackend("testapp", "10.0.0.2:8080", 0, 0)
+
+  expectEvent(t, ch, EventBackendAdded, "10.0.0.1:8080")
+
+  s.DisableBackend("testapp", "10.0.0.1:8080", "test")
+  ev := expectEvent(t, ch, EventBackendDisabled, "10.0.0.1:8080")
+  if ev.App != "testapp" || ev.Old != StateLive || ev.New != StateDead || ev.Reason != "test" || ev.Time.IsZero() {
+    t.Fatal("Unexpected event", ev)
+  }
+
+  s.RemoveBackend("testapp", "10.0.0.1:8080")
+  expectEvent(t, ch, EventBackendRemoved, "10.0.0.1:8080")
+
+  err := s.RemoveBackend("testapp", "10.0.0.1:8080")
+  if err != ErrNoBackend {
+    t.Fatal("Removed missing backend", err)
+  }
+
+  err = s.RemoveHostname("testapp", "missing.com")
+  if err != ErrNoHostname {
+    t.Fatal("Removed missing hostname", err)
+  }
+
+  // nothing was published for them
+  s.DisableBackend("testapp", "10.0.0.2:8080", "test")
+  select {
+  case ev := <-ch:
+    if ev.Type != EventBackendDisabled {
+      t.Fatal("Unexpected event", ev)
+    }
+  case <-time.After(time.Second):
+    t.Fatal("Missing event", EventBackendDisabled)
+  }
+
+  s.RemoveApplication("testapp")
+  expectEvent(t, ch, EventBackendRemoved, "10.0.0.2:8080")
+  expectEvent(t, ch, EventApplicationRemoved, "")
+
+  cert, key := testCertificate(t, "www.example.com")
+  s.SetCertificate("www.example.com", cert, key)
+  ev = expectEvent(t, ch, EventCertificateAdded, "")
+  if ev.Hostname != "www.example.com" {
+    t.Fatal("Unexpected event", ev)
+  }
+
+  s.RemoveCertificate("www.example.com")
+  ev = expectEvent(t, ch, EventCertificateRemoved, "")
+  if ev.Hostname != "www.example.com" {
+    t.Fatal("Unexpected event", ev)
+  }
+}
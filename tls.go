@@ -0,0 +1,69 @@
+package knuckles
+
+import (
+  "crypto/tls"
+  "sync"
+)
+
+// certCache keeps parsed certificates until the stored PEM changes
+type certCache struct {
+  mu      sync.Mutex
+  entries map[string]cachedCert
+}
+
+type cachedCert struct {
+  cert string
+  key  string
+  pair *tls.Certificate
+}
+
+// avoids growing forever on random SNI names matching a wildcard
+const maxCachedCerts = 4096
+
+func newCertCache() *certCache {
+  return &certCache{
+    entries: make(map[string]cachedCert),
+  }
+}
+
+func (c *certCache) get(name, cert, key string) (*tls.Certificate, error) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if e, ok := c.entries[name]; ok && e.cert == cert && e.key == key {
+    return e.pair, nil
+  }
+
+  pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+  if err != nil {
+    return nil, err
+  }
+
+  if len(c.entries) >= maxCachedCerts {
+    c.entries = make(map[string]cachedCert)
+  }
+
+  c.entries[name] = cachedCert{cert: cert, key: key, pair: &pair}
+
+  return &pair, nil
+}
+
+func validCertificate(cert, key string) error {
+  _, err := tls.X509KeyPair([]byte(cert), []byte(key))
+  if err != nil {
+    return ErrInvalidCertificate
+  }
+
+  return nil
+}
+
+// getCertificate selects the certificate by SNI name. Certificates are
+// read from the Store on every handshake so uploads apply right away.
+func (h *HTTPProxy) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+  cert, key, err := h.Config.Store.CertificateForHostname(hello.ServerName)
+  if err != nil {
+    return nil, err
+  }
+
+  return h.certs.get(hello.ServerName, cert, key)
+}